@@ -3,8 +3,15 @@ module github.com/ca17/edns
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/c-robinson/iplib v1.0.3
 	github.com/coredns/caddy v1.1.1
 	github.com/coredns/coredns v1.8.6
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/miekg/dns v1.1.43
+	github.com/prometheus/client_golang v1.11.0
+	go.etcd.io/etcd/api/v3 v3.5.0
+	go.etcd.io/etcd/client/v3 v3.5.0
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	modernc.org/sqlite v1.14.1
 )
@@ -0,0 +1,407 @@
+package setecs
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+const adminApiPrefix = "/api/v1/"
+
+// adminServer is the local http api of the plugin, enabled by the admin
+// directive:
+//
+//	admin 127.0.0.1:8053 {
+//	    token-file /etc/coredns/setecs.token
+//	    state-file /var/lib/coredns/setecs.json
+//	}
+type adminServer struct {
+	sync.Mutex
+	addr      string
+	tokenFile string
+	tokenEnv  string
+	stateFile string
+	se        *SetEcs
+	mux       *http.ServeMux
+	srv       *http.Server
+}
+
+// adminState is the content of the state file: the inline bindings by ecs
+// address and the inline table.
+type adminState struct {
+	Bindings map[string][]string `json:"bindings"`
+	Table    map[string]string   `json:"table"`
+}
+
+func parseAdmin(c *caddy.Controller, se *SetEcs) (*adminServer, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.Errf("format is `admin <address:port> { token-file <file> | token-env <variable> ... }`")
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		return nil, c.Errf("invalid admin address %s", args[0])
+	}
+	admin := &adminServer{addr: args[0], se: se}
+	if c.NextArg() {
+		if c.Val() != "{" {
+			return nil, c.Errf("unexpected token '%s'", c.Val())
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			name := c.Val()
+			args := c.RemainingArgs()
+			switch name {
+			case "token-file":
+				if len(args) != 1 {
+					return nil, c.Errf("format is `token-file <file>`")
+				}
+				admin.tokenFile = args[0]
+			case "token-env":
+				if len(args) != 1 {
+					return nil, c.Errf("format is `token-env <variable>`")
+				}
+				admin.tokenEnv = args[0]
+			case "state-file":
+				if len(args) != 1 {
+					return nil, c.Errf("format is `state-file <file>`")
+				}
+				admin.stateFile = args[0]
+			default:
+				return nil, c.Errf("unknown admin option '%s'", name)
+			}
+		}
+	}
+	if (admin.tokenFile == "") == (admin.tokenEnv == "") {
+		return nil, c.Errf("admin needs one of token-file or token-env")
+	}
+	if _, err := admin.token(); err != nil {
+		return nil, c.Errf("admin token error %s", err.Error())
+	}
+	admin.routes()
+	return admin, nil
+}
+
+// token reads the token on every request so that a rotated token is used
+// without a reload.
+func (a *adminServer) token() (string, error) {
+	var token string
+	if a.tokenFile != "" {
+		b, err := ioutil.ReadFile(a.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(b))
+	} else {
+		v, ok := os.LookupEnv(a.tokenEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", a.tokenEnv)
+		}
+		token = strings.TrimSpace(v)
+	}
+	if token == "" {
+		return "", fmt.Errorf("empty token")
+	}
+	return token, nil
+}
+
+func (a *adminServer) routes() {
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc(adminApiPrefix+"bindings", a.handleBindings)
+	a.mux.HandleFunc(adminApiPrefix+"bindings/", a.handleBinding)
+	a.mux.HandleFunc(adminApiPrefix+"table", a.handleTable)
+	a.mux.HandleFunc(adminApiPrefix+"explain", a.readOnly(a.handleExplain))
+	a.mux.HandleFunc(adminApiPrefix+"dump", a.readOnly(a.handleDump))
+	a.mux.HandleFunc(adminApiPrefix+"sources", a.readOnly(a.handleSources))
+	a.mux.HandleFunc(adminApiPrefix+"canary", a.readOnly(a.handleCanary))
+	a.mux.HandleFunc(adminApiPrefix+"canary/promote", a.handlePromote)
+}
+
+// readOnly restricts a handler to GET requests.
+func (a *adminServer) readOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// ServeHTTP checks the bearer token of every request.
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, err := a.token()
+	if err != nil {
+		log.Errorf("Admin token error %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("token unavailable"))
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="setecs"`)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *adminServer) OnStartup() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	a.srv = &http.Server{Handler: a, ReadTimeout: 10 * time.Second, WriteTimeout: 30 * time.Second}
+	srv := a.srv
+	a.Unlock()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin listener %s failed, err: %v", a.addr, err)
+		}
+	}()
+	log.Infof("Admin api listening on %s", a.addr)
+	return nil
+}
+
+func (a *adminServer) OnFinalShutdown() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.srv == nil {
+		return nil
+	}
+	err := a.srv.Close()
+	a.srv = nil
+	return err
+}
+
+// loadState restores the inline bindings and table of the state file. The
+// entries of the state file replace the inline CIDRs of the Corefile.
+func (a *adminServer) loadState() error {
+	if a.stateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state adminState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("state file %s: %v", a.stateFile, err)
+	}
+	for ecs, clients := range state.Bindings {
+		ecsip := net.ParseIP(ecs)
+		if ecsip == nil {
+			return fmt.Errorf("state file %s: invalid ecs address %q", a.stateFile, ecs)
+		}
+		a.se.inlineBinding(ecsip, true).loader.source.(*inlineSource).set(clients)
+	}
+	if len(state.Table) > 0 {
+		a.se.inlineTable(true).loader.source.(*inlineSource).set(tableEntries(state.Table))
+	}
+	log.Infof("Loaded admin state %s: %d bindings, %d table entries", a.stateFile, len(state.Bindings), len(state.Table))
+	return nil
+}
+
+// saveState persists the inline bindings and table after a change.
+func (a *adminServer) saveState() error {
+	if a.stateFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(adminState{Bindings: a.se.InlineBindings(), Table: a.se.InlineTable()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.stateFile, b)
+}
+
+// change applies a change and persists the new state.
+func (a *adminServer) change(w http.ResponseWriter, fn func() error) bool {
+	a.Lock()
+	defer a.Unlock()
+	if err := fn(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return false
+	}
+	if err := a.saveState(); err != nil {
+		log.Errorf("Failed to write admin state %s, err: %v", a.stateFile, err)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("change applied but not persisted: %v", err))
+		return false
+	}
+	return true
+}
+
+type bindingView struct {
+	Ecs     string   `json:"ecs"`
+	Clients []string `json:"clients"`
+}
+
+type clientsRequest struct {
+	Clients []string `json:"clients"`
+}
+
+type promoteRequest struct {
+	Source string `json:"source"` // all canaries when empty
+}
+
+type tableRequest struct {
+	Entries map[string]string `json:"entries"`
+	Clients []string          `json:"clients"`
+}
+
+// handleExplain returns the decision for a client: /api/v1/explain?client=<ip>.
+func (a *adminServer) handleExplain(w http.ResponseWriter, r *http.Request) {
+	client := net.ParseIP(r.URL.Query().Get("client"))
+	if client == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid client address"))
+		return
+	}
+	writeJson(w, http.StatusOK, a.se.Explain(client))
+}
+
+// handleDump returns the effective mapping as json, or as text with
+// ?format=text.
+func (a *adminServer) handleDump(w http.ResponseWriter, r *http.Request) {
+	dump := a.se.Dump()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJson(w, http.StatusOK, dump)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(dump.Text()))
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", r.URL.Query().Get("format")))
+	}
+}
+
+// handleSources returns the load state of every source.
+func (a *adminServer) handleSources(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, a.se.Sources())
+}
+
+// handleCanary lists the canaries in progress.
+func (a *adminServer) handleCanary(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, a.se.Canaries())
+}
+
+// handlePromote applies the canaries of a source to all clients.
+func (a *adminServer) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var req promoteRequest
+	if !readJson(w, r, &req) {
+		return
+	}
+	promoted, err := a.se.PromoteCanary(req.Source)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]int{"promoted": promoted})
+}
+
+// handleBindings lists the inline bindings.
+func (a *adminServer) handleBindings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	views := make([]bindingView, 0)
+	for ecs, clients := range a.se.InlineBindings() {
+		views = append(views, bindingView{Ecs: ecs, Clients: clients})
+	}
+	writeJson(w, http.StatusOK, views)
+}
+
+// handleBinding lists, adds or removes the CIDRs of the inline binding of
+// an ecs address: /api/v1/bindings/<ecs>.
+func (a *adminServer) handleBinding(w http.ResponseWriter, r *http.Request) {
+	ecsip := net.ParseIP(strings.TrimPrefix(r.URL.Path, adminApiPrefix+"bindings/"))
+	if ecsip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ecs address"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var req clientsRequest
+		if !readJson(w, r, &req) {
+			return
+		}
+		if !a.change(w, func() error {
+			if r.Method == http.MethodPost {
+				return a.se.AddClients(ecsip, req.Clients)
+			}
+			return a.se.RemoveClients(ecsip, req.Clients)
+		}) {
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	clients := []string{}
+	if eb := a.se.inlineBinding(ecsip, false); eb != nil {
+		clients = eb.loader.source.(*inlineSource).list()
+	}
+	writeJson(w, http.StatusOK, bindingView{Ecs: ecsip.String(), Clients: clients})
+}
+
+// handleTable lists, sets or removes entries of the inline table.
+func (a *adminServer) handleTable(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var req tableRequest
+		if !readJson(w, r, &req) {
+			return
+		}
+		if !a.change(w, func() error {
+			if r.Method == http.MethodPost {
+				return a.se.SetTableEntries(req.Entries)
+			}
+			return a.se.RemoveTableEntries(req.Clients)
+		}) {
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJson(w, http.StatusOK, tableRequest{Entries: a.se.InlineTable()})
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Failed to write admin response, err: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,185 @@
+package setecs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, token, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminPush(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	corefile := fmt.Sprintf(`setecs {
+        ecs-binding 1.1.1.1 clients 127.0.0.1
+        admin 127.0.0.1:0 {
+            token-file %s
+            state-file %s
+        }
+    }`, tokenFile, filepath.Join(dir, "state.json"))
+	se, err := parseSetEcs(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(se.admin)
+	defer srv.Close()
+
+	if code := adminRequest(t, srv, "GET", "/api/v1/bindings", "wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", code)
+	}
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/api/v1/bindings/1.1.1.1", `{"clients":["10.0.0.0/24"]}`, http.StatusOK},
+		{"POST", "/api/v1/bindings/2.2.2.2", `{"clients":["10.1.0.0/16"]}`, http.StatusOK},
+		{"DELETE", "/api/v1/bindings/1.1.1.1", `{"clients":["127.0.0.1"]}`, http.StatusOK},
+		{"POST", "/api/v1/bindings/1.1.1.1", `{"clients":["bad"]}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/table", `{"entries":{"10.9.0.1":"3.3.3.3"}}`, http.StatusOK},
+		{"GET", "/api/v1/bindings", "", http.StatusOK},
+	} {
+		if code := adminRequest(t, srv, tc.method, tc.path, "secret", tc.body); code != tc.code {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.path, tc.code, code)
+		}
+	}
+
+	check := func(se *SetEcs) {
+		t.Helper()
+		for client, ecs := range map[string]string{"10.0.0.1": "1.1.1.1", "10.1.2.3": "2.2.2.2", "127.0.0.1": ""} {
+			if got := se.MatchEcsBinding(net.ParseIP(client)); (ecs == "" && got != nil) || (ecs != "" && !got.Equal(net.ParseIP(ecs))) {
+				t.Fatalf("%s: expected %q, got %v", client, ecs, got)
+			}
+		}
+		if got := se.MatchEcsTable("10.9.0.1"); !got.Equal(net.ParseIP("3.3.3.3")) {
+			t.Fatalf("expected pushed table entry, got %v", got)
+		}
+	}
+	check(se)
+
+	// the state file is re-read on startup
+	restarted, err := parseSetEcs(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restarted)
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"token":       "secret",
+		"clients.txt": "# clients\n10.0.0.0/24\n10.0.1.0/24\n",
+		"table.txt":   "10.0.1.5:9.9.9.9\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	se, err := parseSetEcs(caddy.NewTestController("dns", fmt.Sprintf(`setecs {
+        ecs-table %s
+        ecs-binding 8.8.8.8 clients %s
+        admin 127.0.0.1:0 {
+            token-file %s
+        }
+    }`, filepath.Join(dir, "table.txt"), filepath.Join(dir, "clients.txt"), filepath.Join(dir, "token"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(se.admin)
+	defer srv.Close()
+
+	e := se.Explain(net.ParseIP("10.0.1.5"))
+	if e.Match == nil || e.Match.Kind != "ecs-table" || e.Match.Line != 1 || e.Subnet != "9.9.9.0/24" {
+		t.Fatalf("unexpected decision %+v", e)
+	}
+	if len(e.Shadowed) != 1 || e.Shadowed[0].Entry != "10.0.1.0/24" || e.Shadowed[0].Line != 3 {
+		t.Fatalf("expected the binding line to be shadowed, got %+v", e.Shadowed)
+	}
+	if e := se.Explain(net.ParseIP("192.168.0.1")); e.Match != nil {
+		t.Fatalf("unexpected match %+v", e.Match)
+	}
+	if text := se.Dump().Text(); !strings.Contains(text, "10.0.0.0/23 8.8.8.8\n") || !strings.Contains(text, "10.0.1.5 9.9.9.9\n") {
+		t.Fatalf("unexpected dump %q", text)
+	}
+	if sources := se.Sources(); len(sources) != 2 || sources[0].Entries != 1 || sources[1].Entries != 1 || sources[1].Hash == 0 {
+		t.Fatalf("unexpected sources %+v", sources)
+	}
+
+	for path, code := range map[string]int{
+		"/api/v1/explain?client=10.0.1.5": http.StatusOK,
+		"/api/v1/explain?client=bad":      http.StatusBadRequest,
+		"/api/v1/dump":                    http.StatusOK,
+		"/api/v1/dump?format=text":        http.StatusOK,
+		"/api/v1/dump?format=xml":         http.StatusBadRequest,
+		"/api/v1/sources":                 http.StatusOK,
+	} {
+		if got := adminRequest(t, srv, "GET", path, "secret", ""); got != code {
+			t.Fatalf("%s: expected %d, got %d", path, code, got)
+		}
+	}
+	if got := adminRequest(t, srv, "POST", "/api/v1/sources", "secret", ""); got != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", got)
+	}
+}
+
+func TestPushPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.txt")
+	if err := ioutil.WriteFile(path, []byte("10.250.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	se, err := parseSetEcs(caddy.NewTestController("dns", `setecs {
+        ecs-binding 1.1.1.1 clients `+path+`
+        ecs-binding 2.2.2.2 clients 10.240.0.0/16
+    }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the inline binding of the Corefile is reused where it is listed
+	if err := se.AddClients(net.ParseIP("2.2.2.2"), []string{"10.250.1.0/24", "10.241.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(se.ecsBindings) != 2 || !se.ecsBindings[1].isInline() {
+		t.Fatalf("expected the inline binding to stay second, got %v", se.ecsBindings)
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.241.0.1")); !ip.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("expected pushed client to match, got %v", ip)
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.250.1.1")); !ip.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("expected the earlier file binding to win, got %v", ip)
+	}
+
+	// a binding created by a push goes first
+	if err := se.AddClients(net.ParseIP("3.3.3.3"), []string{"10.250.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.250.2.1")); !ip.Equal(net.ParseIP("3.3.3.3")) {
+		t.Fatalf("expected the pushed binding to win, got %v", ip)
+	}
+}
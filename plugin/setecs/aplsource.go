@@ -0,0 +1,339 @@
+package setecs
+
+import (
+	"fmt"
+	"net"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c-robinson/iplib"
+	"github.com/miekg/dns"
+)
+
+const (
+	aplTimeout = 5 * time.Second
+	// aplDefaultRetry is used until the first SOA of the zone is known.
+	aplDefaultRetry = 30 * time.Second
+)
+
+func init() {
+	RegisterSource("axfr", newAplSource)
+}
+
+// notifyHandler is implemented by sources refreshed by DNS NOTIFY messages.
+type notifyHandler interface {
+	// handleNotify reports whether the NOTIFY for zone sent by from was
+	// accepted.
+	handleNotify(zone string, from net.IP) bool
+}
+
+// aplSource transfers a zone from its primary and reads the prefixes of the
+// APL records (RFC 3123) as client CIDRs for ecs-binding. The first transfer
+// is an AXFR, later ones are IXFR from the serial in use. The zone is
+// checked for a new serial when the SOA refresh timer fires or a NOTIFY
+// arrives, the reload ticker is not used.
+//
+//	axfr://192.0.2.53/ecs.example.com?name=clients
+type aplSource struct {
+	sync.RWMutex
+	uri     string
+	primary string
+	zone    string
+	owner   string // only APL records of this owner, all when empty
+	serial  uint32
+	loaded  bool
+	records map[string]*dns.APL
+	refresh time.Duration
+	retry   time.Duration
+	kick    chan struct{}
+	dirty   bool
+	pending int32
+	err     error
+}
+
+func newAplSource(u *neturl.URL, opts *SourceOptions) (Source, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing primary")
+	}
+	zone := strings.Trim(u.Path, "/")
+	if zone == "" {
+		return nil, fmt.Errorf("missing zone")
+	}
+	zone = dns.Fqdn(strings.ToLower(zone))
+	primary := u.Host
+	if u.Port() == "" {
+		primary = net.JoinHostPort(u.Hostname(), "53")
+	}
+	owner := u.Query().Get("name")
+	if owner != "" {
+		owner = strings.ToLower(owner)
+		if !dns.IsFqdn(owner) {
+			owner = owner + "." + zone
+		}
+	}
+	return &aplSource{
+		uri:     u.String(),
+		primary: primary,
+		zone:    zone,
+		owner:   owner,
+		records: make(map[string]*dns.APL),
+		kick:    make(chan struct{}, 1),
+		dirty:   true,
+	}, nil
+}
+
+// Changed reports a change when a newer serial was seen or the last
+// transfer failed.
+func (as *aplSource) Changed() bool {
+	as.RLock()
+	defer as.RUnlock()
+	return as.dirty
+}
+
+func (as *aplSource) Load() ([]byte, error) {
+	as.Lock()
+	as.dirty = false
+	serial, loaded := as.serial, as.loaded
+	as.Unlock()
+
+	rrs, incremental, err := as.transfer(serial, loaded)
+	as.Lock()
+	defer as.Unlock()
+	as.err = err
+	if err != nil {
+		as.dirty = true
+		return nil, err
+	}
+	as.apply(rrs, incremental)
+	return as.render(), nil
+}
+
+// transfer requests an IXFR when a serial is known, falling back to an AXFR
+// when the primary refuses it.
+func (as *aplSource) transfer(serial uint32, loaded bool) ([]dns.RR, bool, error) {
+	if loaded {
+		m := new(dns.Msg)
+		m.SetIxfr(as.zone, serial, ".", ".")
+		rrs, err := as.receive(m)
+		if err == nil {
+			return rrs, true, nil
+		}
+		log.Debugf("IXFR of %s from %s failed, falling back to AXFR, err: %v", as.zone, as.primary, err)
+	}
+	m := new(dns.Msg)
+	m.SetAxfr(as.zone)
+	rrs, err := as.receive(m)
+	return rrs, false, err
+}
+
+func (as *aplSource) receive(m *dns.Msg) ([]dns.RR, error) {
+	t := &dns.Transfer{DialTimeout: aplTimeout, ReadTimeout: aplTimeout}
+	envelopes, err := t.In(m, as.primary)
+	if err != nil {
+		return nil, err
+	}
+	rrs := make([]dns.RR, 0)
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("empty transfer")
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		return nil, dns.ErrSoa
+	}
+	return rrs, nil
+}
+
+// apply updates the records from a transfer. A full transfer replaces all
+// records; an incremental one is a sequence of deletions and additions, each
+// introduced by a SOA.
+func (as *aplSource) apply(rrs []dns.RR, incremental bool) {
+	soa := rrs[0].(*dns.SOA)
+	as.refresh = time.Duration(soa.Refresh) * time.Second
+	as.retry = time.Duration(soa.Retry) * time.Second
+	if len(rrs) == 1 || (as.loaded && soa.Serial == as.serial) {
+		// the zone is up to date
+		return
+	}
+	_, lastSoa := rrs[len(rrs)-1].(*dns.SOA)
+	full := !incremental || len(rrs) <= 2
+	if !full {
+		_, ixfr := rrs[1].(*dns.SOA)
+		full = !ixfr
+	}
+	if full {
+		as.records = make(map[string]*dns.APL)
+	}
+	deleting := false
+	end := len(rrs)
+	if lastSoa {
+		end--
+	}
+	for _, rr := range rrs[1:end] {
+		if _, ok := rr.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+		apl, ok := rr.(*dns.APL)
+		if !ok || (as.owner != "" && strings.ToLower(apl.Hdr.Name) != as.owner) {
+			continue
+		}
+		key := aplKey(apl)
+		if !full && deleting {
+			delete(as.records, key)
+		} else {
+			as.records[key] = apl
+		}
+	}
+	log.Debugf("Transferred %s from %s, serial %d -> %d, %d records, %d APL records",
+		as.zone, as.primary, as.serial, soa.Serial, len(rrs), len(as.records))
+	as.serial = soa.Serial
+	as.loaded = true
+}
+
+// aplKey identifies a record independently of its TTL.
+func aplKey(apl *dns.APL) string {
+	rr := dns.Copy(apl)
+	rr.Header().Ttl = 0
+	return strings.ToLower(rr.String())
+}
+
+// render returns the prefixes of all records, one per line. Negated
+// prefixes are subtracted from the prefixes of all records, so that a
+// client they list is never matched.
+func (as *aplSource) render() []byte {
+	nets := make([]iplib.Net, 0)
+	negated := make([]iplib.Net, 0)
+	for _, apl := range as.records {
+		for _, prefix := range apl.Prefixes {
+			ones, _ := prefix.Network.Mask.Size()
+			n := iplib.NewNet(prefix.Network.IP, ones)
+			if prefix.Negation {
+				negated = append(negated, n)
+			} else {
+				nets = append(nets, n)
+			}
+		}
+	}
+	lines := make([]string, 0, len(nets))
+	for _, n := range excludeNets(nets, negated) {
+		lines = append(lines, n.String())
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Revision returns the serial of the zone in use.
+func (as *aplSource) Revision() int64 {
+	as.RLock()
+	defer as.RUnlock()
+	return int64(as.serial)
+}
+
+// Watch checks the serial of the zone on the SOA refresh timer, or the retry
+// timer after a failure, and whenever a NOTIFY arrives.
+func (as *aplSource) Watch(stop <-chan struct{}, notify func()) {
+	var failed bool
+	for {
+		timer := time.NewTimer(as.nextCheck(failed))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-as.kick:
+			timer.Stop()
+		case <-timer.C:
+		}
+		newer, err := as.check()
+		failed = err != nil
+		if failed {
+			log.Warningf("SOA check of %s at %s failed, err: %v", as.zone, as.primary, err)
+		}
+		if newer {
+			as.Lock()
+			as.dirty = true
+			as.Unlock()
+		}
+		if newer || as.Changed() {
+			debounceNotify(&as.pending, func() {
+				select {
+				case <-stop:
+				default:
+					notify()
+				}
+			})
+		}
+	}
+}
+
+func (as *aplSource) nextCheck(failed bool) time.Duration {
+	as.RLock()
+	defer as.RUnlock()
+	if failed || as.err != nil || as.refresh == 0 {
+		if as.retry > 0 {
+			return as.retry
+		}
+		return aplDefaultRetry
+	}
+	return as.refresh
+}
+
+// check reports whether the primary serves a serial other than the one in
+// use.
+func (as *aplSource) check() (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(as.zone, dns.TypeSOA)
+	c := &dns.Client{Timeout: aplTimeout}
+	in, _, err := c.Exchange(m, as.primary)
+	if err == nil && in.Truncated {
+		c.Net = "tcp"
+		in, _, err = c.Exchange(m, as.primary)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range in.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			as.RLock()
+			defer as.RUnlock()
+			return !as.loaded || soa.Serial != as.serial, nil
+		}
+	}
+	return false, fmt.Errorf("no SOA in answer, rcode %s", dns.RcodeToString[in.Rcode])
+}
+
+// handleNotify accepts a NOTIFY for the zone. When the primary is given as
+// an address the NOTIFY must come from it; either way it only triggers a
+// SOA check against the primary.
+func (as *aplSource) handleNotify(zone string, from net.IP) bool {
+	if !strings.EqualFold(dns.Fqdn(zone), as.zone) {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(as.primary)
+	if ip := net.ParseIP(host); ip != nil && !ip.Equal(from) {
+		log.Warningf("NOTIFY for %s from %s ignored, primary is %s", zone, from, host)
+		return false
+	}
+	select {
+	case as.kick <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (as *aplSource) Health() error {
+	as.RLock()
+	defer as.RUnlock()
+	return as.err
+}
+
+func (as *aplSource) String() string {
+	return as.uri
+}
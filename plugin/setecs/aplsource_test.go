@@ -0,0 +1,147 @@
+package setecs
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// testPrimary serves a zone over AXFR and IXFR, keeping the previous
+// version to answer an IXFR from its serial with the difference.
+type testPrimary struct {
+	sync.Mutex
+	soa     *dns.SOA
+	records []dns.RR
+	prevSoa *dns.SOA
+	prev    []dns.RR
+	ixfrs   int
+}
+
+func newTestSoa(serial uint32) *dns.SOA {
+	rr, _ := dns.NewRR("ecs.test. 3600 IN SOA ns.ecs.test. admin.ecs.test. 1 3600 600 86400 60")
+	soa := rr.(*dns.SOA)
+	soa.Serial = serial
+	return soa
+}
+
+func testRecords(lines ...string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(lines))
+	for _, l := range lines {
+		rr, err := dns.NewRR(l)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (p *testPrimary) update(serial uint32, records []dns.RR) {
+	p.Lock()
+	defer p.Unlock()
+	p.prevSoa, p.prev = p.soa, p.records
+	p.soa, p.records = newTestSoa(serial), records
+}
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	p.Lock()
+	defer p.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	switch r.Question[0].Qtype {
+	case dns.TypeSOA:
+		m.Answer = []dns.RR{p.soa}
+	case dns.TypeAXFR:
+		m.Answer = append(append([]dns.RR{p.soa}, p.records...), p.soa)
+	case dns.TypeIXFR:
+		p.ixfrs++
+		serial := r.Ns[0].(*dns.SOA).Serial
+		switch {
+		case serial == p.soa.Serial:
+			m.Answer = []dns.RR{p.soa}
+		case p.prevSoa != nil && serial == p.prevSoa.Serial:
+			m.Answer = append([]dns.RR{p.soa, p.prevSoa}, p.prev...)
+			m.Answer = append(append(m.Answer, p.soa), p.records...)
+			m.Answer = append(m.Answer, p.soa)
+		default:
+			m.Answer = append(append([]dns.RR{p.soa}, p.records...), p.soa)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func startTestPrimary(t *testing.T, p *testPrimary) string {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*dns.Server{{Listener: tcp, Handler: p}, {PacketConn: udp, Handler: p}} {
+		s := s
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+	}
+	return tcp.Addr().String()
+}
+
+func TestAplSource(t *testing.T) {
+	primary := &testPrimary{}
+	primary.update(1, testRecords(
+		"clients.ecs.test. 3600 IN APL 1:10.0.0.0/24 !1:10.0.0.128/25 2:2001:db8::/32",
+		"other.ecs.test. 3600 IN APL 1:192.168.0.0/16",
+	))
+	addr := startTestPrimary(t, primary)
+
+	se := NewSetEcs()
+	if err := se.parseEcsBinding("8.8.8.8", []string{"axfr://" + addr + "/ecs.test?name=clients"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	se.initialLoad()
+	for ip, match := range map[string]bool{"10.0.0.1": true, "10.0.0.200": false, "2001:db8::1": true, "192.168.0.1": false} {
+		if got := se.MatchEcsBinding(net.ParseIP(ip)) != nil; got != match {
+			t.Fatalf("%s: expected match %v, got %v", ip, match, got)
+		}
+	}
+	loader := se.ecsBindings[0].loader
+	if loader.Status().Revision != 1 {
+		t.Fatalf("expected serial 1, got %+v", loader.Status())
+	}
+
+	if err := se.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer se.OnShutdown()
+
+	// a NOTIFY from another address than the primary is not handled here
+	if se.handleNotify("ecs.test.", net.ParseIP("192.0.2.1")) {
+		t.Fatal("NOTIFY from a foreign address accepted")
+	}
+
+	primary.update(2, testRecords(
+		"clients.ecs.test. 3600 IN APL 1:10.0.0.0/24 2:2001:db8::/32",
+		"clients.ecs.test. 3600 IN APL 1:10.1.0.0/16",
+		"other.ecs.test. 3600 IN APL 1:192.168.0.0/16",
+	))
+	m := new(dns.Msg)
+	m.SetNotify("ecs.test.")
+	se.ServeDNS(context.Background(), &test.ResponseWriter{RemoteIP: "127.0.0.1"}, m)
+	waitFor(t, "transfer after NOTIFY", func() bool {
+		return se.MatchEcsBinding(net.ParseIP("10.1.2.3")) != nil
+	})
+	if status := loader.Status(); status.Revision != 2 || status.Entries != 3 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	primary.Lock()
+	ixfrs := primary.ixfrs
+	primary.Unlock()
+	if ixfrs == 0 {
+		t.Fatal("expected an incremental transfer")
+	}
+}
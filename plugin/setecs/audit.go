@@ -0,0 +1,244 @@
+package setecs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+const (
+	defaultAuditBuffer  = 4096
+	defaultAuditMaxSize = 100 << 20
+	defaultAuditBackups = 5
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time      time.Time    `json:"time"`
+	Client    string       `json:"client"`
+	Name      string       `json:"qname"`
+	Type      string       `json:"qtype"`
+	ClientEcs string       `json:"client_ecs,omitempty"`
+	Ecs       string       `json:"ecs,omitempty"` // the subnet sent upstream
+	Action    string       `json:"action"`
+	Source    string       `json:"source,omitempty"`
+	Arm       string       `json:"arm,omitempty"`    // the experiment arm
+	Scope     *uint8       `json:"scope,omitempty"`  // scope prefix length of the upstream echo
+	Shadow    *auditShadow `json:"shadow,omitempty"` // the decision including the shadow sources
+}
+
+// auditShadow is the shadow decision of an audit entry.
+type auditShadow struct {
+	Ecs    string `json:"ecs,omitempty"`
+	Action string `json:"action"`
+	Source string `json:"source,omitempty"`
+	Agree  bool   `json:"agree"`
+}
+
+// auditLog writes the ECS decisions as JSON lines, enabled by the audit
+// directive:
+//
+//	audit /var/log/coredns/setecs.jsonl {
+//	    sample 0.1
+//	    max-size 50
+//	    max-backups 3
+//	    buffer 8192
+//	}
+//
+// Entries go through a buffered channel to a single writer, an entry that
+// does not fit in the buffer is dropped rather than delaying the query.
+type auditLog struct {
+	path       string
+	sample     float64 // share of the queries logged, 1 for all
+	maxSize    int64   // rotate when the file would grow beyond, in bytes
+	maxBackups int
+	bufferSize int
+
+	mu      sync.RWMutex // guards entries against writes after shutdown
+	entries chan auditEntry
+	done    chan struct{}
+	file    *os.File
+	size    int64
+	moved   bool // the file was rotated away and a new one is still to be opened
+}
+
+func parseAudit(c *caddy.Controller) (*auditLog, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.Errf("format is `audit <file> { sample <rate> ; max-size <MB> ; max-backups <n> ; buffer <entries> }`")
+	}
+	a := &auditLog{
+		path:       args[0],
+		sample:     1,
+		maxSize:    defaultAuditMaxSize,
+		maxBackups: defaultAuditBackups,
+		bufferSize: defaultAuditBuffer,
+	}
+	if c.NextArg() {
+		if c.Val() != "{" {
+			return nil, c.Errf("unexpected token '%s'", c.Val())
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			name := c.Val()
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.Errf("format is `%s <value>`", name)
+			}
+			switch name {
+			case "sample":
+				rate, err := strconv.ParseFloat(args[0], 64)
+				if err != nil || rate <= 0 || rate > 1 {
+					return nil, c.Errf("invalid audit sample rate '%s', expected (0, 1]", args[0])
+				}
+				a.sample = rate
+			case "max-size":
+				mb, err := strconv.Atoi(args[0])
+				if err != nil || mb <= 0 {
+					return nil, c.Errf("invalid audit max-size '%s'", args[0])
+				}
+				a.maxSize = int64(mb) << 20
+			case "max-backups":
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 0 {
+					return nil, c.Errf("invalid audit max-backups '%s'", args[0])
+				}
+				a.maxBackups = n
+			case "buffer":
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					return nil, c.Errf("invalid audit buffer '%s'", args[0])
+				}
+				a.bufferSize = n
+			default:
+				return nil, c.Errf("unknown audit option '%s'", name)
+			}
+		}
+	}
+	return a, nil
+}
+
+// sampled reports whether a query is to be logged.
+func (a *auditLog) sampled() bool {
+	return a != nil && (a.sample >= 1 || rand.Float64() < a.sample)
+}
+
+// write queues an entry without blocking.
+func (a *auditLog) write(e auditEntry) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.entries == nil {
+		return
+	}
+	select {
+	case a.entries <- e:
+	default:
+		auditDropped.Inc()
+	}
+}
+
+// OnStartup opens the file and starts the writer.
+func (a *auditLog) OnStartup() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("audit %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit %s", err)
+	}
+	a.file, a.size = f, info.Size()
+	entries := make(chan auditEntry, a.bufferSize)
+	a.done = make(chan struct{})
+	a.mu.Lock()
+	a.entries = entries
+	a.mu.Unlock()
+	go a.run(entries)
+	return nil
+}
+
+// OnShutdown writes the queued entries and closes the file.
+func (a *auditLog) OnShutdown() error {
+	a.mu.Lock()
+	entries := a.entries
+	a.entries = nil
+	a.mu.Unlock()
+	if entries != nil {
+		close(entries)
+		<-a.done
+	}
+	return nil
+}
+
+func (a *auditLog) run(entries chan auditEntry) {
+	defer close(a.done)
+	w := bufio.NewWriter(a.file)
+	for e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+		if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+			w.Flush()
+			if err := a.rotate(); err != nil {
+				log.Warningf("Failed to rotate audit log %s: %v", a.path, err)
+			}
+			w.Reset(a.file)
+		}
+		if _, err := w.Write(line); err != nil {
+			log.Warningf("Failed to write audit log %s: %v", a.path, err)
+			continue
+		}
+		a.size += int64(len(line))
+		if len(entries) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	a.file.Close()
+}
+
+// rotate renames the file to file.1, shifting older backups up to
+// max-backups, and opens a new file. The file is reopened even when the
+// rename fails. When the new file cannot be opened the old descriptor stays
+// in use and the next write retries the open, without moving the backups
+// again.
+func (a *auditLog) rotate() error {
+	var err error
+	if !a.moved {
+		if a.maxBackups == 0 {
+			err = os.Remove(a.path)
+		} else {
+			for i := a.maxBackups - 1; i > 0; i-- {
+				os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+			}
+			err = os.Rename(a.path, a.path+".1")
+		}
+		a.moved = true
+	}
+	f, openErr := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if openErr != nil {
+		auditRotateFailures.Inc()
+		return openErr
+	}
+	info, statErr := f.Stat()
+	if statErr != nil {
+		f.Close()
+		auditRotateFailures.Inc()
+		return statErr
+	}
+	a.file.Close()
+	a.file, a.size, a.moved = f, info.Size(), false
+	return err
+}
@@ -0,0 +1,133 @@
+package setecs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	c := caddy.NewTestController("dns", `setecs {
+        ecs-binding 1.1.1.1 clients 10.240.0.0/16
+        audit `+path+` {
+            max-backups 2
+        }
+    }`)
+	se, err := parseSetEcs(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se.Next = test.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		ecs := *getMsgECS(r)
+		ecs.SourceScope = 16
+		setECS(m, &ecs)
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	se.audit.maxSize = 400 // two entries per file
+	if err := se.audit.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if _, err := se.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := se.audit.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(rotated)+string(current)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(lines))
+	}
+	var e auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Client != "10.240.0.1" || e.Name != "example.org." || e.Type != "A" || e.Ecs != "1.1.1.0/24" ||
+		e.Action != decisionBinding || e.Source != "inline" || e.Scope == nil || *e.Scope != 16 {
+		t.Fatalf("unexpected entry %s", lines[0])
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("expected a single backup, got %v", err)
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{path: path, maxBackups: 2, file: f}
+	for i := 1; i <= 4; i++ {
+		if _, err := a.file.WriteString(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i < 4 {
+			if err := a.rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a.file.Close()
+	// the oldest backup is dropped, the others are shifted
+	for file, want := range map[string]string{path: "4", path + ".1": "3", path + ".2": "2"} {
+		if got, err := ioutil.ReadFile(file); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", file, got, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected 2 backups, got %v", err)
+	}
+
+	// a failed open keeps the old file in use
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := testutil.ToFloat64(auditRotateFailures)
+	a = &auditLog{path: filepath.Join(dir, "missing", "audit.jsonl"), maxBackups: 2, file: f}
+	if err := a.rotate(); err == nil {
+		t.Fatal("expected the open to fail")
+	}
+	if got := testutil.ToFloat64(auditRotateFailures) - failures; got != 1 {
+		t.Errorf("audit_rotate_failures_total increased by %v, want 1", got)
+	}
+	if a.file != f || !a.moved {
+		t.Fatal("expected the old file to stay in use")
+	}
+	if _, err := a.file.WriteString("5"); err != nil {
+		t.Fatalf("old file closed: %v", err)
+	}
+	a.file.Close()
+	if got, _ := ioutil.ReadFile(path); string(got) != "45" {
+		t.Fatalf("expected the entry in the old file, got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package setecs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachePath returns the file holding the last known good content of url.
+func cachePath(dir, url string) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x.cache", StringHash(url)))
+}
+
+// readCache returns the cached content of url together with the time it was
+// written.
+func readCache(dir, url string) ([]byte, time.Time, error) {
+	path := cachePath(dir, url)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return content, stat.ModTime(), nil
+}
+
+// writeCache atomically replaces the cached content of url.
+func writeCache(dir, url string, content []byte) error {
+	return writeFileAtomic(cachePath(dir, url), content)
+}
+
+// writeFileAtomic replaces path through a temporary file in the same
+// directory, so that readers never see a partial file.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".setecs-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadCache hands the cached content of a url source and its signature,
+// nil when none was cached, to load, logging and exporting its age when
+// load accepts it.
+func loadCache(dir, url string, load func(content, sig []byte) bool) {
+	if dir == "" || url == "" {
+		return
+	}
+	content, mtime, err := readCache(dir, url)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read cache of %q, err: %v", redactURL(url), err)
+		}
+		return
+	}
+	sig, err := ioutil.ReadFile(cachePath(dir, url) + ".sig")
+	if err != nil {
+		sig = nil
+	}
+	if !load(content, sig) {
+		return
+	}
+	log.Infof("Loaded cached copy of %q, age %v", redactURL(url), time.Since(mtime).Truncate(time.Second))
+	cacheTimestamp.WithLabelValues(redactURL(url)).Set(float64(mtime.Unix()))
+}
+
+// saveCache persists the content of a url source after a successful load,
+// together with its signature when it has one.
+func saveCache(dir, url string, content, sig []byte) {
+	if dir == "" {
+		return
+	}
+	sigPath := cachePath(dir, url) + ".sig"
+	if sig != nil {
+		if err := writeFileAtomic(sigPath, sig); err != nil {
+			log.Warningf("Failed to write cache of %q, err: %v", redactURL(url), err)
+			return
+		}
+	} else {
+		os.Remove(sigPath)
+	}
+	if err := writeCache(dir, url, content); err != nil {
+		log.Warningf("Failed to write cache of %q, err: %v", redactURL(url), err)
+		return
+	}
+	cacheTimestamp.WithLabelValues(redactURL(url)).SetToCurrentTime()
+}
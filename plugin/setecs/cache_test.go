@@ -0,0 +1,111 @@
+package setecs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUrlSourceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setecs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("172.21.2.0/24\n"))
+	}))
+	defer srv.Close()
+
+	uri := srv.URL + "/clients.txt"
+	src, err := newSource(uri, nil)
+	if err != nil || src == nil {
+		t.Fatalf("no source for %s: %v", uri, err)
+	}
+	eb := newEcsBinding(net.ParseIP("8.8.8.8"), src, uri, nil)
+	eb.loader.cacheDir = dir
+	eb.loader.load()
+	if !eb.existIp(net.ParseIP("172.21.2.1")) {
+		t.Fatal("expected client from url")
+	}
+
+	up = false
+	src2, _ := newSource(uri, nil)
+	eb2 := newEcsBinding(net.ParseIP("8.8.8.8"), src2, uri, nil)
+	eb2.loader.cacheDir = dir
+	eb2.loader.loadFromCache()
+	eb2.loader.load()
+	if !eb2.existIp(net.ParseIP("172.21.2.1")) {
+		t.Fatal("expected client from cache")
+	}
+	if eb2.loader.Status().LastError == "" {
+		t.Fatal("expected fetch error in status")
+	}
+}
+
+func TestUrlSourceCacheChecks(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("172.21.2.0/24\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, content))))
+			return
+		}
+		w.Write(content)
+	}))
+	uri := srv.URL + "/clients.txt"
+	opts := newSourceOptions()
+	if opts.verifier, err = parseVerifyKey(base64.StdEncoding.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	}
+	opts.guard.rejectEmpty = true
+	fromCache := func() *ecsBinding {
+		src, _ := newSource(uri, opts)
+		eb := newEcsBinding(net.ParseIP("8.8.8.8"), src, uri, opts)
+		eb.loader.cacheDir = dir
+		eb.loader.loadFromCache()
+		return eb
+	}
+
+	eb := fromCache()
+	eb.loader.load()
+	srv.Close()
+	if eb := fromCache(); !eb.existIp(net.ParseIP("172.21.2.1")) {
+		t.Fatal("expected the verified cached copy to load")
+	}
+
+	if err := ioutil.WriteFile(cachePath(dir, uri), []byte("0.0.0.0/0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if eb := fromCache(); eb.size() != 0 {
+		t.Fatal("expected a tampered cached copy to be ignored")
+	}
+
+	empty := []byte("# no clients\n")
+	if err := ioutil.WriteFile(cachePath(dir, uri), empty, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cachePath(dir, uri)+".sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, empty))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if eb := fromCache(); eb.loader.Status().LastError == "" {
+		t.Fatal("expected an empty cached copy to be rejected by the guard")
+	}
+}
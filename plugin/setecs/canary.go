@@ -0,0 +1,227 @@
+package setecs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-robinson/iplib"
+	"github.com/coredns/caddy"
+)
+
+// canaryRollout holds the canary option of a source: a new version of the
+// list is first applied to a share of the clients, selected by a stable
+// hash of the client address, and promoted to all of them after a window or
+// through the admin api.
+type canaryRollout struct {
+	percent int           // share of the clients served by the new version, 0 disables
+	window  time.Duration // time before the new version is promoted, 0 for manual promotion
+}
+
+func (cr *canaryRollout) parseCanaryOption(c *caddy.Controller, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return c.Errf("format is `canary <percent> [window]`")
+	}
+	v, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+	if err != nil || v <= 0 || v >= 100 {
+		return c.Errf("invalid canary percent '%s', expected 1 to 99", args[0])
+	}
+	cr.percent = v
+	if len(args) == 2 {
+		window, err := time.ParseDuration(args[1])
+		if err != nil || window <= 0 {
+			return c.Errf("invalid canary window '%s'", args[1])
+		}
+		cr.window = window
+	}
+	return nil
+}
+
+func (cr canaryRollout) String() string {
+	if cr.percent == 0 {
+		return ""
+	}
+	if cr.window == 0 {
+		return fmt.Sprintf("canary=%d%%", cr.percent)
+	}
+	return fmt.Sprintf("canary=%d%%/%s", cr.percent, cr.window)
+}
+
+// canaryBucket maps a client to 0-99, the same on every instance.
+func canaryBucket(ip net.IP) int {
+	h := fnv.New32a()
+	if ip4 := ip.To4(); ip4 != nil {
+		h.Write(ip4)
+	} else {
+		h.Write(ip.To16())
+	}
+	return int(h.Sum32() % 100)
+}
+
+// bindingSnapshot is a version of the clients of a binding.
+type bindingSnapshot struct {
+	generation uint64
+	clients    []iplib.Net
+	origins    []clientOrigin
+	staged     time.Time
+}
+
+// canaryRollout returns the rollout of the binding, disabled for inline
+// bindings whose changes come from the Corefile or the admin api.
+func (eb *ecsBinding) canaryRollout() canaryRollout {
+	if eb.loader.opts == nil || eb.isInline() {
+		return canaryRollout{}
+	}
+	return eb.loader.opts.canary
+}
+
+// inCanary reports whether ip is served by the canary snapshot, the lock
+// must be held.
+func (eb *ecsBinding) inCanary(ip net.IP) bool {
+	return eb.canary != nil && canaryBucket(ip) < eb.canaryRollout().percent
+}
+
+// stageCanary keeps the clients of a new version next to the ones in use,
+// replacing an earlier canary and restarting the window, and publishes the
+// difference to the stable version.
+func (eb *ecsBinding) stageCanary(addrs []iplib.Net, origins []clientOrigin) {
+	rollout := eb.canaryRollout()
+	eb.Lock()
+	eb.generation++
+	generation := eb.generation
+	eb.canary = &bindingSnapshot{generation: generation, clients: addrs, origins: origins, staged: time.Now()}
+	added, removed := diffNets(eb.clients, addrs)
+	if eb.window != nil {
+		eb.window.Stop()
+		eb.window = nil
+	}
+	if rollout.window > 0 {
+		eb.window = time.AfterFunc(rollout.window, func() {
+			if eb.promote != nil {
+				eb.promote(generation)
+			} else {
+				eb.promoteCanary(generation)
+			}
+		})
+	}
+	eb.Unlock()
+	log.Infof("Canary of %s ecs %s: %d prefixes for %d%% of the clients", eb.sourceName(), eb.ecsip, len(addrs), rollout.percent)
+	eb.loader.changes.publish(ReloadDiff{
+		Source:  eb.sourceName(),
+		Kind:    "ecs-binding",
+		Ecs:     eb.ecsip.String(),
+		Added:   added,
+		Removed: removed,
+		Canary:  true,
+	})
+}
+
+// promoteCanary applies the canary to all clients, only when it is still
+// the given generation unless generation is 0. It holds the load lock so
+// that a load never stages a canary in between.
+func (eb *ecsBinding) promoteCanary(generation uint64) bool {
+	eb.loader.loadLock.Lock()
+	defer eb.loader.loadLock.Unlock()
+	eb.Lock()
+	c := eb.canary
+	if c == nil || (generation != 0 && c.generation != generation) {
+		eb.Unlock()
+		return false
+	}
+	eb.canary = nil
+	eb.origins = c.origins
+	if eb.window != nil {
+		eb.window.Stop()
+		eb.window = nil
+	}
+	eb.Unlock()
+	eb.replaceClients(c.clients)
+	log.Infof("Promoted canary of %s ecs %s: %d prefixes", eb.sourceName(), eb.ecsip, len(c.clients))
+	return true
+}
+
+// stopCanary stops the window of the canary, which stays staged.
+func (eb *ecsBinding) stopCanary() {
+	eb.Lock()
+	defer eb.Unlock()
+	if eb.window != nil {
+		eb.window.Stop()
+		eb.window = nil
+	}
+}
+
+// CanaryStatus describes a version of a source served to a share of the
+// clients.
+type CanaryStatus struct {
+	Source        string    `json:"source"`
+	Ecs           string    `json:"ecs"`
+	Percent       int       `json:"percent"`
+	Staged        time.Time `json:"staged"`
+	PromoteAt     time.Time `json:"promote_at,omitempty"`
+	Entries       int       `json:"entries"`
+	StableEntries int       `json:"stable_entries"`
+}
+
+// Canaries returns the canaries in progress.
+func (se *SetEcs) Canaries() []CanaryStatus {
+	se.ecsBindingsLock.RLock()
+	defer se.ecsBindingsLock.RUnlock()
+	result := make([]CanaryStatus, 0)
+	for _, binding := range se.ecsBindings {
+		rollout := binding.canaryRollout()
+		binding.RLock()
+		if c := binding.canary; c != nil {
+			status := CanaryStatus{
+				Source:        binding.sourceName(),
+				Ecs:           binding.ecsip.String(),
+				Percent:       rollout.percent,
+				Staged:        c.staged,
+				Entries:       len(c.clients),
+				StableEntries: len(binding.clients),
+			}
+			if rollout.window > 0 {
+				status.PromoteAt = c.staged.Add(rollout.window)
+			}
+			result = append(result, status)
+		}
+		binding.RUnlock()
+	}
+	return result
+}
+
+// PromoteCanary promotes the canaries of a source, or all canaries when
+// source is empty, and returns how many were promoted.
+func (se *SetEcs) PromoteCanary(source string) (int, error) {
+	se.ecsBindingsLock.RLock()
+	bindings := make([]*ecsBinding, 0)
+	for _, binding := range se.ecsBindings {
+		if source == "" || binding.sourceName() == source {
+			bindings = append(bindings, binding)
+		}
+	}
+	se.ecsBindingsLock.RUnlock()
+	promoted := se.promoteCanaries(bindings, 0)
+	if promoted == 0 {
+		return 0, fmt.Errorf("no canary in progress")
+	}
+	return promoted, nil
+}
+
+// promoteCanaries promotes the canaries of bindings, by the admin api with
+// generation 0 or when the window of a generation ends, and analyzes the
+// conflicts of the result.
+func (se *SetEcs) promoteCanaries(bindings []*ecsBinding, generation uint64) int {
+	promoted := 0
+	for _, binding := range bindings {
+		if binding.promoteCanary(generation) {
+			promoted++
+		}
+	}
+	if promoted > 0 {
+		se.analyze()
+	}
+	return promoted
+}
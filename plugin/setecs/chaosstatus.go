@@ -0,0 +1,145 @@
+package setecs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/c-robinson/iplib"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const defaultChaosStatusName = "setecs.server."
+
+// defaultChaosStatusAllow are the clients allowed when no CIDR is listed.
+var defaultChaosStatusAllow = []string{"127.0.0.0/8", "::1/128"}
+
+// cidrList is a list of client networks allowed to use a responder.
+type cidrList []iplib.Net
+
+func parseCidrList(args []string) (cidrList, error) {
+	list := make(cidrList, 0, len(args))
+	for _, arg := range args {
+		n, err := ParseIpNet(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", arg)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosStatus answers CH TXT queries for a name with the state of the
+// sources, enabled by the chaos-status directive:
+//
+//	chaos-status setecs.server. 10.0.0.0/8
+//
+// Only loopback clients are allowed when no CIDR is listed.
+type chaosStatus struct {
+	name  string
+	allow cidrList
+}
+
+func parseChaosStatus(c *caddy.Controller) (*chaosStatus, error) {
+	args := c.RemainingArgs()
+	cs := &chaosStatus{name: defaultChaosStatusName}
+	if len(args) > 0 && !strings.Contains(args[0], "/") && net.ParseIP(args[0]) == nil {
+		if _, ok := dns.IsDomainName(args[0]); !ok {
+			return nil, c.Errf("invalid chaos-status name %s", args[0])
+		}
+		cs.name = dns.Fqdn(strings.ToLower(args[0]))
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		args = defaultChaosStatusAllow
+	}
+	allow, err := parseCidrList(args)
+	if err != nil {
+		return nil, c.Errf("chaos-status %s", err.Error())
+	}
+	cs.allow = allow
+	return cs, nil
+}
+
+// match reports whether the query is a CH query for the name.
+func (cs *chaosStatus) match(state request.Request) bool {
+	return cs != nil && state.QClass() == dns.ClassCHAOS && state.Name() == cs.name
+}
+
+// serve answers the query, REFUSED for clients outside of the allowed
+// CIDRs and an empty answer for other types than TXT.
+func (cs *chaosStatus) serve(se *SetEcs, state request.Request, client net.IP) int {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	if !cs.allow.contains(client) {
+		m.Rcode = dns.RcodeRefused
+		state.W.WriteMsg(m)
+		return dns.RcodeRefused
+	}
+	if state.QType() == dns.TypeTXT {
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		for _, txt := range statusTxt(se) {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: splitTxt(txt)})
+		}
+	}
+	m.Truncate(state.Size())
+	state.W.WriteMsg(m)
+	return dns.RcodeSuccess
+}
+
+// statusTxt renders the state of the plugin: a summary followed by one
+// string per source.
+func statusTxt(se *SetEcs) []string {
+	sources := se.Sources()
+	failing := 0
+	for _, s := range sources {
+		if s.LastError != "" {
+			failing++
+		}
+	}
+	txt := []string{fmt.Sprintf("sources=%d failing=%d version=%d", len(sources), failing, se.Generation())}
+	for _, s := range sources {
+		line := fmt.Sprintf("source=%s kind=%s", s.Source, s.Kind)
+		if s.Ecs != "" {
+			line += " ecs=" + s.Ecs
+		}
+		line += fmt.Sprintf(" entries=%d", s.Entries)
+		if s.Snapshot == snapshotCanary {
+			line += fmt.Sprintf(" snapshot=canary stable-entries=%d", s.StableEntries)
+		}
+		if !s.LastLoad.IsZero() {
+			line += " loaded=" + s.LastLoad.UTC().Format(time.RFC3339)
+		}
+		if s.Revision > 0 {
+			line += fmt.Sprintf(" revision=%d", s.Revision)
+		}
+		if s.LastError != "" {
+			line += " error=" + s.LastError
+		}
+		txt = append(txt, line)
+	}
+	return txt
+}
+
+// splitTxt splits s into the 255 byte strings of a TXT record.
+func splitTxt(s string) []string {
+	var parts []string
+	for len(s) > 255 {
+		parts = append(parts, s[:255])
+		s = s[255:]
+	}
+	return append(parts, s)
+}
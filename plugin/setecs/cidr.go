@@ -0,0 +1,138 @@
+package setecs
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/c-robinson/iplib"
+)
+
+// netRange returns the first and last address of n in 16 byte form.
+func netRange(n iplib.Net) (net.IP, net.IP) {
+	ip, mask := n.IP(), n.Mask()
+	first := make(net.IP, len(ip))
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		first[i] = ip[i] & mask[i]
+		last[i] = ip[i] | ^mask[i]
+	}
+	return first.To16(), last.To16()
+}
+
+type netSpan struct {
+	net   iplib.Net
+	first net.IP
+	last  net.IP
+	ones  int
+}
+
+func newNetSpan(n iplib.Net) netSpan {
+	first, last := netRange(n)
+	ones, _ := n.Mask().Size()
+	return netSpan{net: n, first: first, last: last, ones: ones}
+}
+
+// aggregateNets normalises a list of prefixes: host bits are masked,
+// duplicates and prefixes covered by another one are dropped, and adjacent
+// prefixes are merged into their supernet. IPv4 and IPv6 prefixes are
+// aggregated apart, an IPv6 prefix never covers an IPv4 one even when it
+// spans ::ffff:0:0/96.
+func aggregateNets(nets []iplib.Net) []iplib.Net {
+	spans4 := make([]netSpan, 0, len(nets))
+	spans6 := make([]netSpan, 0)
+	for _, n := range nets {
+		ones, _ := n.Mask().Size()
+		// rebuild so that host bits are always cleared
+		span := newNetSpan(iplib.NewNet(n.IP(), ones))
+		if span.net.Version() == iplib.IP4Version {
+			spans4 = append(spans4, span)
+		} else {
+			spans6 = append(spans6, span)
+		}
+	}
+	result := make([]iplib.Net, 0, len(nets))
+	result = append(result, aggregateSpans(spans4)...)
+	return append(result, aggregateSpans(spans6)...)
+}
+
+// aggregateSpans aggregates the prefixes of a single family.
+func aggregateSpans(spans []netSpan) []iplib.Net {
+	sort.Slice(spans, func(i, j int) bool {
+		if c := bytes.Compare(spans[i].first, spans[j].first); c != 0 {
+			return c < 0
+		}
+		return spans[i].ones < spans[j].ones
+	})
+
+	stack := make([]netSpan, 0, len(spans))
+	for _, span := range spans {
+		if len(stack) > 0 && bytes.Compare(span.last, stack[len(stack)-1].last) <= 0 {
+			continue // duplicate or covered
+		}
+		stack = append(stack, span)
+		for len(stack) >= 2 {
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			if !siblings(a, b) {
+				break
+			}
+			stack = append(stack[:len(stack)-2], newNetSpan(iplib.NewNet(a.net.IP(), a.ones-1)))
+		}
+	}
+
+	result := make([]iplib.Net, 0, len(stack))
+	for _, span := range stack {
+		result = append(result, span.net)
+	}
+	return result
+}
+
+// siblings reports whether a and b are the two halves of the same supernet.
+func siblings(a, b netSpan) bool {
+	if a.ones != b.ones || a.ones == 0 || a.net.Version() != b.net.Version() {
+		return false
+	}
+	if !iplib.NextIP(a.last).Equal(b.first) {
+		return false
+	}
+	parent := iplib.NewNet(a.net.IP(), a.ones-1)
+	return parent.IP().Equal(a.net.IP())
+}
+
+// excludeNets returns the parts of nets outside of every prefix of exclude.
+// A prefix partially covered by an excluded one is split into its halves
+// until each half is either covered or clear.
+func excludeNets(nets, exclude []iplib.Net) []iplib.Net {
+	result := make([]iplib.Net, 0, len(nets))
+	for _, n := range nets {
+		result = append(result, excludeNet(n, exclude)...)
+	}
+	return result
+}
+
+func excludeNet(n iplib.Net, exclude []iplib.Net) []iplib.Net {
+	split := false
+	for _, x := range exclude {
+		if x.Version() != n.Version() {
+			continue
+		}
+		if x.ContainsNet(n) {
+			return nil
+		}
+		if n.ContainsNet(x) {
+			split = true
+		}
+	}
+	if !split {
+		return []iplib.Net{n}
+	}
+	ones, _ := n.Mask().Size()
+	low := iplib.NewNet(n.IP(), ones+1)
+	_, last := netRange(low)
+	next := iplib.NextIP(last)
+	if ip4 := next.To4(); ip4 != nil && n.Version() == iplib.IP4Version {
+		next = ip4
+	}
+	high := iplib.NewNet(next, ones+1)
+	return append(excludeNet(low, exclude), excludeNet(high, exclude)...)
+}
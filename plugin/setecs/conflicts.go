@@ -0,0 +1,227 @@
+package setecs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/c-robinson/iplib"
+)
+
+// ConflictKind classifies a conflict found by the analyzer.
+type ConflictKind string
+
+const (
+	// ConflictOverlap is a prefix covered by another prefix of the same source.
+	ConflictOverlap ConflictKind = "overlap"
+	// ConflictShadowed is a prefix of a binding covered by an earlier binding
+	// with a different ecs address, the earlier binding wins.
+	ConflictShadowed ConflictKind = "shadowed"
+	// ConflictTableBinding is a client of an ecs-table that a binding maps to a
+	// different ecs address, the table wins.
+	ConflictTableBinding ConflictKind = "table-binding"
+)
+
+// Conflict describes two entries that claim the same clients.
+type Conflict struct {
+	Kind        ConflictKind `json:"kind"`
+	Entry       string       `json:"entry"`
+	Source      string       `json:"source"`
+	Ecs         string       `json:"ecs"`
+	Other       string       `json:"other"`
+	OtherSource string       `json:"other_source"`
+	OtherEcs    string       `json:"other_ecs"`
+	Winner      string       `json:"winner,omitempty"`
+}
+
+func (c Conflict) String() string {
+	s := fmt.Sprintf("%s: %s (%s, ecs %s) overlaps %s (%s, ecs %s)",
+		c.Kind, c.Entry, c.Source, c.Ecs, c.Other, c.OtherSource, c.OtherEcs)
+	if c.Winner != "" {
+		s += ", " + c.Winner + " wins"
+	}
+	return s
+}
+
+type conflictEntry struct {
+	net    iplib.Net
+	first  net.IP
+	last   net.IP
+	source string
+	ecs    net.IP
+	order  int // position of the binding or table
+	table  bool
+}
+
+// analyzeConflicts sweeps the prefixes of every binding, as listed before
+// aggregation, and the clients of every table in address order, IPv4 before
+// IPv6. While walking, the stack holds the binding prefixes containing the
+// current entry, so every containment is seen once.
+func analyzeConflicts(bindings []*ecsBinding, tables []*ecsTable) []Conflict {
+	entries := make([]conflictEntry, 0)
+	for i, b := range bindings {
+		b.RLock()
+		for _, o := range b.origins {
+			n := o.net
+			first, last := netRange(n)
+			entries = append(entries, conflictEntry{
+				net: n, first: first, last: last, source: b.sourceName(), ecs: b.ecsip, order: i,
+			})
+		}
+		b.RUnlock()
+	}
+	for i, t := range tables {
+		t.RLock()
+		for client, ecs := range t.dict {
+			n, err := ParseIpNet(client)
+			if err != nil {
+				continue
+			}
+			first, last := netRange(n)
+			entries = append(entries, conflictEntry{
+				net: n, first: first, last: last,
+				source: t.sourceName(), ecs: ecs, order: i, table: true,
+			})
+		}
+		t.RUnlock()
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if vi, vj := entries[i].net.Version(), entries[j].net.Version(); vi != vj {
+			return vi < vj
+		}
+		if c := bytes.Compare(entries[i].first, entries[j].first); c != 0 {
+			return c < 0
+		}
+		if c := bytes.Compare(entries[i].last, entries[j].last); c != 0 {
+			return c > 0
+		}
+		// tables after bindings, earlier sources first
+		if entries[i].table != entries[j].table {
+			return !entries[i].table
+		}
+		return entries[i].order < entries[j].order
+	})
+
+	conflicts := make([]Conflict, 0)
+	stack := make([]*conflictEntry, 0)
+	for i := range entries {
+		cur := &entries[i]
+		for len(stack) > 0 && (stack[len(stack)-1].net.Version() != cur.net.Version() ||
+			bytes.Compare(stack[len(stack)-1].last, cur.first) < 0) {
+			stack = stack[:len(stack)-1]
+		}
+		if cur.table {
+			if winner := firstBinding(stack); winner != nil && !winner.ecs.Equal(cur.ecs) {
+				conflicts = append(conflicts, newConflict(ConflictTableBinding, cur, winner, cur.source))
+			}
+			continue
+		}
+		for _, outer := range stack {
+			switch {
+			case outer.order == cur.order:
+				conflicts = append(conflicts, newConflict(ConflictOverlap, cur, outer, ""))
+			case !outer.ecs.Equal(cur.ecs):
+				winner := outer
+				if cur.order < outer.order {
+					winner = cur
+				}
+				conflicts = append(conflicts, newConflict(ConflictShadowed, cur, outer, winner.source))
+			}
+		}
+		stack = append(stack, cur)
+	}
+	return conflicts
+}
+
+// firstBinding returns the binding MatchEcsBinding would pick among the
+// prefixes on the stack.
+func firstBinding(stack []*conflictEntry) *conflictEntry {
+	var winner *conflictEntry
+	for _, e := range stack {
+		if winner == nil || e.order < winner.order {
+			winner = e
+		}
+	}
+	return winner
+}
+
+func newConflict(kind ConflictKind, entry, other *conflictEntry, winner string) Conflict {
+	return Conflict{
+		Kind:        kind,
+		Entry:       entry.net.String(),
+		Source:      entry.source,
+		Ecs:         entry.ecs.String(),
+		Other:       other.net.String(),
+		OtherSource: other.source,
+		OtherEcs:    other.ecs.String(),
+		Winner:      winner,
+	}
+}
+
+// Conflicts returns the result of the last conflict analysis.
+func (se *SetEcs) Conflicts() []Conflict {
+	se.conflictsLock.RLock()
+	defer se.conflictsLock.RUnlock()
+	return se.conflicts
+}
+
+// analyze runs the conflict analyzer on the sources applied to queries and
+// logs the conflicts when they differ from the previous run. Sources in
+// shadow mode never win a match and are left out.
+func (se *SetEcs) analyze() {
+	se.ecsBindingsLock.RLock()
+	se.ecsTablesLock.RLock()
+	bindings := make([]*ecsBinding, 0, len(se.ecsBindings))
+	for _, b := range se.ecsBindings {
+		if !se.inShadow(b.loader) {
+			bindings = append(bindings, b)
+		}
+	}
+	tables := make([]*ecsTable, 0, len(se.ecsTables))
+	for _, t := range se.ecsTables {
+		if !se.inShadow(t.loader) {
+			tables = append(tables, t)
+		}
+	}
+	conflicts := analyzeConflicts(bindings, tables)
+	se.ecsTablesLock.RUnlock()
+	se.ecsBindingsLock.RUnlock()
+
+	se.conflictsLock.Lock()
+	changed := !sameConflicts(se.conflicts, conflicts)
+	se.conflicts = conflicts
+	se.conflictsLock.Unlock()
+
+	if !changed || len(conflicts) == 0 {
+		return
+	}
+	counts := make(map[ConflictKind]int)
+	for i, c := range conflicts {
+		counts[c.Kind]++
+		if i < maxLoggedChanges {
+			log.Warning(c.String())
+		}
+	}
+	parts := make([]string, 0, len(counts))
+	for _, kind := range []ConflictKind{ConflictOverlap, ConflictShadowed, ConflictTableBinding} {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", kind, counts[kind]))
+		}
+	}
+	log.Warningf("Found %d conflicts: %s", len(conflicts), strings.Join(parts, " "))
+}
+
+func sameConflicts(a, b []Conflict) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
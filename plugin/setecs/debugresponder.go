@@ -0,0 +1,101 @@
+package setecs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// debugResponder answers TXT queries for a special name with the decision
+// of the plugin for the querying client, enabled by the debug-responder
+// directive:
+//
+//	debug-responder ecs.debug. 10.0.0.0/8 192.168.0.0/16
+type debugResponder struct {
+	name  string
+	allow cidrList
+}
+
+func parseDebugResponder(c *caddy.Controller) (*debugResponder, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return nil, c.Errf("format is `debug-responder <name> <allowed cidr>...`")
+	}
+	if _, ok := dns.IsDomainName(args[0]); !ok {
+		return nil, c.Errf("invalid debug-responder name %s", args[0])
+	}
+	allow, err := parseCidrList(args[1:])
+	if err != nil {
+		return nil, c.Errf("debug-responder %s", err.Error())
+	}
+	return &debugResponder{name: dns.Fqdn(strings.ToLower(args[0])), allow: allow}, nil
+}
+
+// match reports whether the query is for the name of the responder.
+func (dr *debugResponder) match(state request.Request) bool {
+	return dr != nil && state.Name() == dr.name
+}
+
+// serve answers the query, REFUSED for clients outside of the allowed
+// CIDRs and an empty answer for other types than TXT.
+func (dr *debugResponder) serve(se *SetEcs, state request.Request, client net.IP) int {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	if !dr.allow.contains(client) {
+		m.Rcode = dns.RcodeRefused
+		state.W.WriteMsg(m)
+		return dns.RcodeRefused
+	}
+	if state.QType() == dns.TypeTXT {
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+		for _, txt := range debugTxt(se.Explain(client), getMsgECS(state.Req)) {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: splitTxt(txt)})
+		}
+	}
+	m.Truncate(state.Size())
+	state.W.WriteMsg(m)
+	return dns.RcodeSuccess
+}
+
+// debugTxt renders an explanation as key=value strings.
+func debugTxt(e Explanation, clientEcs *dns.EDNS0_SUBNET) []string {
+	txt := []string{"client=" + e.Client}
+	if clientEcs != nil {
+		txt = append(txt, fmt.Sprintf("client-ecs=%s/%d", clientEcs.Address, clientEcs.SourceNetmask))
+	} else {
+		txt = append(txt, "client-ecs=none")
+	}
+	switch {
+	case e.Match != nil:
+		txt = append(txt, "ecs="+e.Subnet, "match="+debugMatch(*e.Match))
+	case e.Subnet != "":
+		txt = append(txt, "ecs="+e.Subnet, "match=default")
+	default:
+		txt = append(txt, "ecs=none", "match=none")
+	}
+	if e.Arm != "" {
+		txt = append(txt, "arm="+e.Arm)
+	}
+	for _, s := range e.Shadowed {
+		txt = append(txt, "shadowed="+debugMatch(s))
+	}
+	return txt
+}
+
+// debugMatch renders a match as `kind source[:line] entry ecs address`,
+// followed by `shadow` for the entries of sources in shadow mode.
+func debugMatch(m Match) string {
+	source := m.Source
+	if m.Line > 0 {
+		source = fmt.Sprintf("%s:%d", m.Source, m.Line)
+	}
+	if m.Shadow {
+		return fmt.Sprintf("%s %s %s ecs %s shadow", m.Kind, source, m.Entry, m.Ecs)
+	}
+	return fmt.Sprintf("%s %s %s ecs %s", m.Kind, source, m.Entry, m.Ecs)
+}
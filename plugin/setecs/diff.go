@@ -0,0 +1,138 @@
+package setecs
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/c-robinson/iplib"
+)
+
+// ReloadDiff describes how a reload changed the snapshot of one source.
+type ReloadDiff struct {
+	Source string `json:"source"`
+	Kind   string `json:"kind"`          // ecs-binding or ecs-table
+	Ecs    string `json:"ecs,omitempty"` // ecs address of a binding
+	// Added and Removed hold client CIDRs of a binding or client addresses
+	// of a table.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Changed holds table clients whose ecs address changed, as
+	// client:old->new.
+	Changed []string `json:"changed,omitempty"`
+	// Canary is set when the new version is only served to the canary
+	// share of the clients, the diff is against the stable version.
+	Canary bool `json:"canary,omitempty"`
+}
+
+// Empty reports whether the reload changed nothing.
+func (d ReloadDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ChangeListener is called after a reload changed a source.
+type ChangeListener func(diff ReloadDiff)
+
+// maxLoggedChanges limits how many entries of a diff are written to the log,
+// listeners always receive the whole diff.
+const maxLoggedChanges = 100
+
+type changeNotifier struct {
+	sync.RWMutex
+	listeners []ChangeListener
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{listeners: make([]ChangeListener, 0)}
+}
+
+func (n *changeNotifier) subscribe(fn ChangeListener) {
+	n.Lock()
+	defer n.Unlock()
+	n.listeners = append(n.listeners, fn)
+}
+
+// publish logs the diff and hands it to every listener.
+func (n *changeNotifier) publish(diff ReloadDiff) {
+	if diff.Empty() {
+		return
+	}
+	logged := diff
+	logged.Added = truncateChanges(diff.Added)
+	logged.Removed = truncateChanges(diff.Removed)
+	logged.Changed = truncateChanges(diff.Changed)
+	if b, err := json.Marshal(logged); err == nil {
+		log.Infof("Reload diff: added %d, removed %d, changed %d %s",
+			len(diff.Added), len(diff.Removed), len(diff.Changed), b)
+	}
+
+	if n == nil {
+		return
+	}
+	n.RLock()
+	listeners := n.listeners
+	n.RUnlock()
+	for _, fn := range listeners {
+		fn(diff)
+	}
+}
+
+func truncateChanges(s []string) []string {
+	if len(s) > maxLoggedChanges {
+		return append(s[:maxLoggedChanges:maxLoggedChanges], "...")
+	}
+	return s
+}
+
+func diffNets(prev, next []iplib.Net) (added, removed []string) {
+	before := make(map[string]struct{}, len(prev))
+	for _, n := range prev {
+		before[n.String()] = struct{}{}
+	}
+	after := make(map[string]struct{}, len(next))
+	for _, n := range next {
+		after[n.String()] = struct{}{}
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func diffDicts(prev, next map[string]net.IP) (added, removed, changed []string) {
+	for k, ip := range next {
+		old, ok := prev[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !old.Equal(ip):
+			changed = append(changed, k+":"+old.String()+"->"+ip.String())
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// OnChange registers fn to be called after every reload that changes a
+// source. Other plugins can reach the SetEcs instance through
+// dnsserver.GetConfig(c).Handler("setecs").
+func (se *SetEcs) OnChange(fn ChangeListener) {
+	se.changes.subscribe(fn)
+}
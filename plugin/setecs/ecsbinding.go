@@ -1,10 +1,8 @@
 package setecs
 
 import (
-	"bufio"
 	"io"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +10,10 @@ import (
 	"github.com/c-robinson/iplib"
 )
 
+// Item types of the clients of a binding or table.
+//
+// Deprecated: bindings and tables read a Source chosen by the scheme of the
+// item, see RegisterSource. The constants are kept for compatibility only.
 const (
 	ItemTypePath = iota
 	ItemTypeUrl
@@ -20,30 +22,31 @@ const (
 
 type ecsBinding struct {
 	sync.RWMutex
-	whichType   int
-	path        string
-	mtime       time.Time
-	size        int64
-	url         string
-	contentHash uint64
-	ecsip       net.IP
-	clients     []iplib.Net
-	inline      []iplib.Net
-}
-
-func newEcsBinding(wtype int, ecsip net.IP, path, url string) *ecsBinding {
-	return &ecsBinding{
-		RWMutex:     sync.RWMutex{},
-		whichType:   wtype,
-		path:        path,
-		mtime:       time.Time{},
-		size:        0,
-		url:         url,
-		contentHash: 0,
-		ecsip:       ecsip,
-		clients:     make([]iplib.Net, 0),
-		inline:      make([]iplib.Net, 0),
+	loader     *sourceLoader
+	ecsip      net.IP
+	clients    []iplib.Net
+	origins    []clientOrigin
+	loaded     bool             // a version was applied, later ones go through the canary
+	canary     *bindingSnapshot // the new version while it is served to a share of the clients
+	generation uint64           // of the last canary
+	window     *time.Timer      // promotes the canary when its window ends
+	promote    func(generation uint64)
+}
+
+// clientOrigin is a prefix as listed in the source, before aggregation.
+type clientOrigin struct {
+	net  iplib.Net
+	line int
+}
+
+func newEcsBinding(ecsip net.IP, source Source, uri string, opts *SourceOptions) *ecsBinding {
+	eb := &ecsBinding{
+		RWMutex: sync.RWMutex{},
+		ecsip:   ecsip,
+		clients: make([]iplib.Net, 0),
 	}
+	eb.loader = newSourceLoader(source, uri, opts, eb)
+	return eb
 }
 
 func (eb *ecsBinding) existIpNet(inet iplib.Net) bool {
@@ -60,7 +63,11 @@ func (eb *ecsBinding) existIpNet(inet iplib.Net) bool {
 func (eb *ecsBinding) existIp(ip net.IP) bool {
 	eb.RLock()
 	defer eb.RUnlock()
-	for _, ipnet := range eb.clients {
+	clients := eb.clients
+	if eb.inCanary(ip) {
+		clients = eb.canary.clients
+	}
+	for _, ipnet := range clients {
 		if ipnet.Contains(ip) {
 			return true
 		}
@@ -68,13 +75,19 @@ func (eb *ecsBinding) existIp(ip net.IP) bool {
 	return false
 }
 
-func (eb *ecsBinding) addInline(client iplib.Net) bool {
-	if eb.existIpNet(client) {
+// isInline reports whether the binding holds the CIDRs of the Corefile.
+// The inline CIDRs of shadow bindings are kept apart.
+func (eb *ecsBinding) isInline() bool {
+	_, ok := eb.loader.source.(*inlineSource)
+	return ok && !eb.loader.isShadow()
+}
+
+func (eb *ecsBinding) addInline(client string) bool {
+	inline, ok := eb.loader.source.(*inlineSource)
+	if !ok {
 		return false
 	}
-	eb.Lock()
-	defer eb.Unlock()
-	eb.inline = append(eb.inline, client)
+	inline.add(client)
 	return true
 }
 
@@ -89,131 +102,109 @@ func (eb *ecsBinding) parentIpNet(inet iplib.Net) iplib.Net {
 	return nil
 }
 
-func (eb *ecsBinding) loadFromFile() {
-	if eb.whichType != ItemTypePath || len(eb.path) == 0 {
-		return
-	}
-	file, err := os.Open(eb.path)
-	if err != nil {
-		log.Errorf("clients file read error %s", eb.path)
-		return
-	}
-
-	stat, err := file.Stat()
-	if err == nil {
-		eb.RLock()
-		mtime := eb.mtime
-		size := eb.size
-		eb.RUnlock()
-
-		if stat.ModTime() == mtime && stat.Size() == size {
+func (eb *ecsBinding) stage(r io.Reader) (int, *parseReport, func()) {
+	addrs, origins, report := eb.parseOrigins(r)
+	return len(addrs), report, func() {
+		eb.Lock()
+		canary := eb.loaded && eb.canaryRollout().percent > 0
+		if !canary {
+			eb.origins = origins
+			eb.loaded = true
+			eb.canary = nil
+		}
+		eb.Unlock()
+		if canary {
+			eb.stageCanary(addrs, origins)
 			return
 		}
-	} else {
-		// Proceed parsing anyway
-		log.Warningf("%v", err)
+		eb.replaceClients(addrs)
 	}
+}
 
-	t1 := time.Now()
-	addrs, totalLines := eb.parse(file)
-	t2 := time.Since(t1)
-	log.Debugf("Parsed %v  time spent: %v name added: %v / %v", file.Name(), t2, len(addrs), totalLines)
+func (eb *ecsBinding) size() int {
+	eb.RLock()
+	defer eb.RUnlock()
+	return len(eb.clients)
+}
 
+// replaceClients swaps in a new snapshot and publishes what changed.
+func (eb *ecsBinding) replaceClients(addrs []iplib.Net) {
 	eb.Lock()
+	added, removed := diffNets(eb.clients, addrs)
 	eb.clients = addrs
-	eb.mtime = stat.ModTime()
-	eb.size = stat.Size()
 	eb.Unlock()
+	eb.loader.changes.publish(ReloadDiff{
+		Source:  eb.sourceName(),
+		Kind:    "ecs-binding",
+		Ecs:     eb.ecsip.String(),
+		Added:   added,
+		Removed: removed,
+	})
 }
 
-func (eb *ecsBinding) parse(r io.Reader) ([]iplib.Net, uint64) {
-	addrs := make([]iplib.Net, 0)
-	var totalLines uint64
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		totalLines++
-
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
+func (eb *ecsBinding) parse(r io.Reader) ([]iplib.Net, *parseReport) {
+	addrs, _, report := eb.parseOrigins(r)
+	return addrs, report
+}
 
-		addr, err := ParseIpNet(line)
+// parseOrigins returns the aggregated prefixes of the content together with
+// the prefixes and lines they were aggregated from.
+func (eb *ecsBinding) parseOrigins(r io.Reader) ([]iplib.Net, []clientOrigin, *parseReport) {
+	addrs := make([]iplib.Net, 0)
+	origins := make([]clientOrigin, 0)
+	report := newParseReport(eb.sourceName())
+	report.scan(r, func(l listLine) {
+		addr, err := ParseIpNet(l.text)
 		if err != nil {
-			log.Errorf("error netaddr %s %s", line, err.Error())
-			continue
-		}
-
-		for _, inet := range addrs {
-			if addr.ContainsNet(inet) {
-				log.Warningf("%s ContainsNet %s", addr.String(), inet.String())
-				continue
-			}
+			report.errorf(l, 0, "invalid client address %q", l.text)
+			return
 		}
 		addrs = append(addrs, addr)
-	}
-
-	return addrs, totalLines
+		origins = append(origins, clientOrigin{net: addr, line: l.line})
+	})
+	parsed := len(addrs)
+	addrs = aggregateNets(addrs)
+	log.Debugf("Aggregated %s: %d -> %d prefixes", report.source, parsed, len(addrs))
+	return addrs, origins, report
 }
 
-func (eb *ecsBinding) loadFromUrl() {
-	if eb.whichType != ItemTypeUrl || len(eb.url) == 0 {
-		return
-	}
-
-	t1 := time.Now()
-	content, err := HttpGet(eb.url, nil)
-	t2 := time.Since(t1)
-	if err != nil {
-		log.Warningf("Failed to update %q, err: %v", eb.url, err)
-		return
-	}
-	contentStr := string(content)
-
+// origin returns the first listed prefix containing ip, or nil.
+func (eb *ecsBinding) origin(ip net.IP) *clientOrigin {
 	eb.RLock()
-	contentHash := eb.contentHash
-	eb.RUnlock()
-	contentHash1 := StringHash(contentStr)
-	if contentHash1 == contentHash {
-		return
+	defer eb.RUnlock()
+	origins := eb.origins
+	if eb.inCanary(ip) {
+		origins = eb.canary.origins
 	}
-
-	addrs := make([]iplib.Net, 0)
-	var totalLines uint64
-	t3 := time.Now()
-	lines := strings.Split(contentStr, "\n")
-	for _, line := range lines {
-		totalLines++
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
-		addr, err := ParseIpNet(line)
-		if err != nil {
-			log.Errorf("error netaddr %s %s", line, err.Error())
-			continue
+	for i := range origins {
+		if origins[i].net.Contains(ip) {
+			o := origins[i]
+			return &o
 		}
-		for _, inet := range addrs {
-			if addr.ContainsNet(inet) {
-				log.Warningf("%s ContainsNet %s", addr.String(), inet.String())
-				continue
-			}
-		}
-		addrs = append(addrs, addr)
 	}
-	t4 := time.Since(t3)
-	log.Debugf("Fetched %v, time spent: %v %v, added: %v / %v, hash: %#x",
-		eb.url, t2, t4, len(addrs), totalLines, contentHash1)
+	return nil
+}
 
-	eb.Lock()
-	eb.clients = addrs
-	eb.contentHash = contentHash1
-	eb.Unlock()
+// sourceName identifies the source in logs and diagnostics.
+func (eb *ecsBinding) sourceName() string {
+	return eb.loader.source.String()
+}
+
+// Diagnostics returns the problems found by the last parse of the source.
+func (eb *ecsBinding) Diagnostics() []Diagnostic {
+	return eb.loader.Diagnostics()
 }
 
 func (eb *ecsBinding) String() string {
 	sb := strings.Builder{}
 	sb.WriteString("ecsBinding:ecsip=")
 	sb.WriteString(eb.ecsip.String())
+	sb.WriteString(";source=")
+	sb.WriteString(eb.sourceName())
+	if opts := eb.loader.opts.String(); opts != "" {
+		sb.WriteString(";options=")
+		sb.WriteString(opts)
+	}
 	sb.WriteString(";clients=")
 	c := 0
 	for _, client := range eb.clients {
@@ -225,16 +216,5 @@ func (eb *ecsBinding) String() string {
 		sb.WriteString(",")
 		c += 1
 	}
-	sb.WriteString(";inlines=")
-	cc := 0
-	for _, il := range eb.inline {
-		if cc >= 5 {
-			sb.WriteString("......")
-			break
-		}
-		sb.WriteString(il.String())
-		sb.WriteString(",")
-		cc += 1
-	}
 	return sb.String()
 }
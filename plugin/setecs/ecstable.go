@@ -1,157 +1,214 @@
 package setecs
 
 import (
-	"bufio"
 	"io"
 	"net"
-	"os"
+	"sort"
 	"strings"
 	"sync"
-	"time"
+
+	"github.com/c-robinson/iplib"
 )
 
 type ecsTable struct {
 	sync.RWMutex
-	whichType   int
-	path        string
-	mtime       time.Time
-	size        int64
-	url         string
-	contentHash uint64
-	dict  map[string]net.IP
+	loader *sourceLoader
+	dict   map[string]net.IP
+	lines  map[string]int // line of every client in the source
+	groups []tableGroup   // CIDR clients by ecs address, in the order of their first row
 }
 
+// tableGroup holds the CIDR clients of a table mapped to one ecs address, as
+// the clients of a binding.
+type tableGroup struct {
+	ecsip   net.IP
+	clients []iplib.Net // aggregated
+	origins []iplib.Net // as listed
+}
 
-func newEcsTable(wtype int, path, url string) *ecsTable {
-	return &ecsTable{
+func newEcsTable(source Source, uri string, opts *SourceOptions) *ecsTable {
+	et := &ecsTable{
 		RWMutex: sync.RWMutex{},
-		whichType:   wtype,
-		path:        path,
-		mtime:       time.Time{},
-		size:        0,
-		url:         url,
-		contentHash: 0,
-		dict:        make(map[string]net.IP),
+		dict:    make(map[string]net.IP),
+		lines:   make(map[string]int),
 	}
+	et.loader = newSourceLoader(source, uri, opts, et)
+	return et
 }
 
+// isInline reports whether the table holds the entries pushed through the
+// admin api.
+func (eb *ecsTable) isInline() bool {
+	_, ok := eb.loader.source.(*inlineSource)
+	return ok
+}
 
-func (eb *ecsTable) loadFromFile() {
-	if eb.whichType != ItemTypePath || len(eb.path) == 0 {
-		return
+// lookup returns the ecs address of a single address client.
+func (eb *ecsTable) lookup(client string) (net.IP, bool) {
+	eb.RLock()
+	defer eb.RUnlock()
+	ecsip, ok := eb.dict[client]
+	return ecsip, ok
+}
+
+// lookupNet returns the most specific CIDR client containing ip, as listed
+// in the source, and its ecs address.
+func (eb *ecsTable) lookupNet(ip net.IP) (string, net.IP, bool) {
+	eb.RLock()
+	defer eb.RUnlock()
+	var best iplib.Net
+	var ecsip net.IP
+	for _, g := range eb.groups {
+		if !containsIp(g.clients, ip) {
+			continue
+		}
+		for _, o := range g.origins {
+			if o.Contains(ip) && (best == nil || maskSize(o) > maskSize(best)) {
+				best, ecsip = o, g.ecsip
+			}
+		}
 	}
-	file, err := os.Open(eb.path)
-	if err != nil {
-		log.Errorf("ecstable file read error %s", eb.path)
-		return
+	if best == nil {
+		return "", nil, false
 	}
+	return best.String(), ecsip, true
+}
 
-	stat, err := file.Stat()
-	if err == nil {
-		eb.RLock()
-		mtime := eb.mtime
-		size := eb.size
-		eb.RUnlock()
-
-		if stat.ModTime() == mtime && stat.Size() == size {
-			return
+func containsIp(nets []iplib.Net, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
 		}
-	} else {
-		// Proceed parsing anyway
-		log.Warningf("%v", err)
 	}
+	return false
+}
 
-	t1 := time.Now()
-	dict, totalLines := eb.parse(file)
-	t2 := time.Since(t1)
-	log.Debugf("Parsed %v  time spent: %v name added: %v / %v", file.Name(), t2, len(dict), totalLines)
+func maskSize(n iplib.Net) int {
+	ones, _ := n.Mask().Size()
+	return ones
+}
+
+// line returns the line of client in the source.
+func (eb *ecsTable) line(client string) int {
+	eb.RLock()
+	defer eb.RUnlock()
+	return eb.lines[client]
+}
+
+func (eb *ecsTable) stage(r io.Reader) (int, *parseReport, func()) {
+	dict, lines, report := eb.parseLines(r)
+	groups := groupNets(dict, lines)
+	return len(dict), report, func() {
+		eb.Lock()
+		eb.lines = lines
+		eb.groups = groups
+		eb.Unlock()
+		eb.replaceDict(dict)
+	}
+}
 
+func (eb *ecsTable) size() int {
+	eb.RLock()
+	defer eb.RUnlock()
+	return len(eb.dict)
+}
+
+// replaceDict swaps in a new snapshot and publishes what changed.
+func (eb *ecsTable) replaceDict(dict map[string]net.IP) {
 	eb.Lock()
+	added, removed, changed := diffDicts(eb.dict, dict)
 	eb.dict = dict
-	eb.mtime = stat.ModTime()
-	eb.size = stat.Size()
 	eb.Unlock()
+	eb.loader.changes.publish(ReloadDiff{
+		Source:  eb.sourceName(),
+		Kind:    "ecs-table",
+		Added:   added,
+		Removed: removed,
+		Changed: changed,
+	})
 }
 
-func (eb *ecsTable) parse(r io.Reader) (map[string]net.IP, uint64) {
+func (eb *ecsTable) parse(r io.Reader) (map[string]net.IP, *parseReport) {
+	dict, _, report := eb.parseLines(r)
+	return dict, report
+}
+
+// parseLines returns the entries of the content together with the line of
+// every client. A CIDR client is keyed by its masked prefix.
+func (eb *ecsTable) parseLines(r io.Reader) (map[string]net.IP, map[string]int, *parseReport) {
 	dict := make(map[string]net.IP)
-	var totalLines uint64
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		totalLines++
-
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
+	lines := make(map[string]int)
+	report := newParseReport(eb.sourceName())
+	report.scan(r, func(l listLine) {
+		sep := strings.IndexByte(l.text, ':')
+		if sep < 0 || strings.Count(l.text, ":") != 1 {
+			report.errorf(l, 0, "expected <client>:<ecs address>, got %q", l.text)
+			return
 		}
-
-		attrs := strings.Split(line, ":")
-		if len(attrs) != 2 {
-			continue
+		client, ecs := l.text[:sep], l.text[sep+1:]
+		if strings.Contains(client, "/") {
+			n, err := ParseIpNet(client)
+			if err != nil {
+				report.errorf(l, 0, "invalid client prefix %q", client)
+				return
+			}
+			client = iplib.NewNet(n.IP(), maskSize(n)).String()
+		} else if !IsIP(client) {
+			report.errorf(l, 0, "invalid client address %q", client)
+			return
 		}
-		if !IsIP(attrs[0]) {
-			continue
+		ip := net.ParseIP(ecs)
+		if ip == nil {
+			report.errorf(l, sep+1, "invalid ecs address %q", ecs)
+			return
 		}
-		ip := net.ParseIP(attrs[1])
-		if ip != nil {
-			dict[attrs[0]] = ip
+		if old, ok := dict[client]; ok && !old.Equal(ip) {
+			report.warnf(l, 0, "client %s redefined, ecs %s replaces %s", client, ip.String(), old.String())
 		}
-	}
-
-	return dict, totalLines
+		dict[client] = ip
+		lines[client] = l.line
+	})
+	return dict, lines, report
 }
 
-func (eb *ecsTable) loadFromUrl() {
-	if eb.whichType != ItemTypeUrl || len(eb.url) == 0 {
-		return
+// groupNets groups the CIDR clients of a table by ecs address, in the order
+// of their first row.
+func groupNets(dict map[string]net.IP, lines map[string]int) []tableGroup {
+	cidrs := make([]string, 0)
+	for client := range dict {
+		if strings.Contains(client, "/") {
+			cidrs = append(cidrs, client)
+		}
 	}
-
-	t1 := time.Now()
-	content, err := HttpGet(eb.url, nil)
-	t2 := time.Since(t1)
-	if err != nil {
-		log.Warningf("Failed to update %q, err: %v", eb.url, err)
-		return
+	sort.Slice(cidrs, func(i, j int) bool { return lines[cidrs[i]] < lines[cidrs[j]] })
+	groups := make([]tableGroup, 0)
+	index := make(map[string]int)
+	for _, client := range cidrs {
+		n, _ := ParseIpNet(client)
+		n = iplib.NewNet(n.IP(), maskSize(n))
+		ecs := dict[client]
+		i, ok := index[ecs.String()]
+		if !ok {
+			i = len(groups)
+			index[ecs.String()] = i
+			groups = append(groups, tableGroup{ecsip: ecs})
+		}
+		groups[i].origins = append(groups[i].origins, n)
 	}
-	contentStr := string(content)
-
-	eb.RLock()
-	contentHash := eb.contentHash
-	eb.RUnlock()
-	contentHash1 := StringHash(contentStr)
-	if contentHash1 == contentHash {
-		return
+	for i := range groups {
+		groups[i].clients = aggregateNets(groups[i].origins)
 	}
+	return groups
+}
 
-	dict := make(map[string]net.IP)
-	var totalLines uint64
-	t3 := time.Now()
-	lines := strings.Split(contentStr, "\n")
-	for _, line := range lines {
-		totalLines++
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
-		attrs := strings.Split(line, ":")
-		if len(attrs) != 2 {
-			continue
-		}
-		if !IsIP(attrs[0]) {
-			continue
-		}
-		ip := net.ParseIP(attrs[1])
-		if ip != nil {
-			dict[attrs[0]] = ip
-		}
-	}
-	t4 := time.Since(t3)
-	log.Debugf("Fetched %v, time spent: %v %v, added: %v / %v, hash: %#x",
-		eb.url, t2, t4, len(dict), totalLines, contentHash1)
+// sourceName identifies the source in logs and diagnostics.
+func (eb *ecsTable) sourceName() string {
+	return eb.loader.source.String()
+}
 
-	eb.Lock()
-	eb.dict = dict
-	eb.contentHash = contentHash1
-	eb.Unlock()
+// Diagnostics returns the problems found by the last parse of the source.
+func (eb *ecsTable) Diagnostics() []Diagnostic {
+	return eb.loader.Diagnostics()
 }
 
 func (eb *ecsTable) String() string {
@@ -170,5 +227,11 @@ func (eb *ecsTable) String() string {
 		c += 1
 	}
 	sb.WriteString("}")
+	sb.WriteString(";source=")
+	sb.WriteString(eb.sourceName())
+	if opts := eb.loader.opts.String(); opts != "" {
+		sb.WriteString(";options=")
+		sb.WriteString(opts)
+	}
 	return sb.String()
 }
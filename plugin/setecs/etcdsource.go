@@ -0,0 +1,239 @@
+package setecs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdTimeout    = 5 * time.Second
+	etcdMaxBackoff = time.Minute
+)
+
+func init() {
+	RegisterSource("etcd", newEtcdSource)
+	RegisterSource("etcds", newEtcdSource)
+}
+
+// etcdSource reads the keys under an etcd prefix. The part of a key after
+// the prefix is the client, the value, if any, is its ecs address: keys with
+// a value yield client:ecs lines for ecs-table, keys without a value yield
+// client CIDRs for ecs-binding. A watch on the prefix keeps all instances
+// reading the same revision.
+//
+//	etcd://10.0.0.1:2379,10.0.0.2:2379/setecs/table
+type etcdSource struct {
+	sync.RWMutex
+	uri      string
+	prefix   string
+	kv       clientv3.KV
+	watcher  clientv3.Watcher
+	closer   io.Closer
+	revision int64 // revision of the last load
+	watching bool
+	dirty    bool
+	pending  int32
+	err      error
+}
+
+func newEtcdSource(u *neturl.URL, opts *SourceOptions) (Source, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing endpoints")
+	}
+	prefix := strings.TrimSuffix(u.Path, "/") + "/"
+	if prefix == "/" {
+		return nil, fmt.Errorf("missing key prefix")
+	}
+	config := clientv3.Config{DialTimeout: etcdTimeout}
+	proto := "http://"
+	if u.Scheme == "etcds" {
+		proto = "https://"
+		config.TLS = &tls.Config{}
+		if opts != nil {
+			var err error
+			if config.TLS, err = opts.tlsConfig(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, endpoint := range strings.Split(u.Host, ",") {
+		config.Endpoints = append(config.Endpoints, proto+endpoint)
+	}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return newEtcdClientSource(u.String(), prefix, client, client, client), nil
+}
+
+// newEtcdClientSource reads prefix through kv and follows it through
+// watcher, closer releases the connection.
+func newEtcdClientSource(uri, prefix string, kv clientv3.KV, watcher clientv3.Watcher, closer io.Closer) *etcdSource {
+	return &etcdSource{uri: uri, prefix: prefix, kv: kv, watcher: watcher, closer: closer, dirty: true}
+}
+
+// Changed reports a change when the watch saw a newer revision. Without a
+// working watch the prefix is read on every reload.
+func (es *etcdSource) Changed() bool {
+	es.RLock()
+	defer es.RUnlock()
+	return es.dirty || !es.watching || es.err != nil
+}
+
+func (es *etcdSource) Load() ([]byte, error) {
+	es.Lock()
+	es.dirty = false
+	es.Unlock()
+	content, revision, err := es.read()
+	es.Lock()
+	defer es.Unlock()
+	es.err = err
+	if err != nil {
+		es.dirty = true
+		return nil, err
+	}
+	es.revision = revision
+	return content, nil
+}
+
+func (es *etcdSource) read() ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := es.kv.Get(ctx, es.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	sb := strings.Builder{}
+	for _, kv := range resp.Kvs {
+		sb.WriteString(strings.TrimPrefix(string(kv.Key), es.prefix))
+		if value := strings.TrimSpace(string(kv.Value)); value != "" {
+			sb.WriteString(":")
+			sb.WriteString(value)
+		}
+		sb.WriteString("\n")
+	}
+	log.Debugf("Read %d keys of %s at revision %d", len(resp.Kvs), es.String(), resp.Header.Revision)
+	return []byte(sb.String()), resp.Header.Revision, nil
+}
+
+// Revision returns the etcd revision of the last load.
+func (es *etcdSource) Revision() int64 {
+	es.RLock()
+	defer es.RUnlock()
+	return es.revision
+}
+
+// Watch follows the prefix from the revision of the last load and restarts
+// the watch with a backoff when the stream fails. The backoff starts over
+// once a stream was established.
+func (es *etcdSource) Watch(stop <-chan struct{}, notify func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	notify = func(notify func()) func() {
+		return func() {
+			if ctx.Err() == nil {
+				notify()
+			}
+		}
+	}(notify)
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		established, err := es.watch(ctx, notify)
+		es.Lock()
+		es.watching = false
+		es.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if established {
+			backoff = time.Second
+		}
+		if err != nil {
+			log.Warningf("Watch of %q failed, retry in %v, err: %v", es.String(), backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > etcdMaxBackoff {
+			backoff = etcdMaxBackoff
+		}
+	}
+}
+
+// watch follows the prefix until the stream ends, established reports
+// whether etcd created the watch.
+func (es *etcdSource) watch(ctx context.Context, notify func()) (established bool, err error) {
+	wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	es.RLock()
+	from := es.revision + 1
+	es.RUnlock()
+	watchOpts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCreatedNotify()}
+	if from > 1 {
+		watchOpts = append(watchOpts, clientv3.WithRev(from))
+	}
+	for resp := range es.watcher.Watch(wctx, es.prefix, watchOpts...) {
+		if err := resp.Err(); err != nil {
+			if err == rpctypes.ErrCompacted {
+				// the revisions since the last load are gone, read everything
+				es.changed(notify)
+			}
+			return established, err
+		}
+		if resp.Created {
+			established = true
+			es.Lock()
+			es.watching = true
+			es.Unlock()
+			log.Debugf("Watching %s from revision %d", es.String(), from)
+			continue
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
+		log.Debugf("Watch of %s: %d events at revision %d", es.String(), len(resp.Events), resp.Header.Revision)
+		es.changed(notify)
+	}
+	return established, ctx.Err()
+}
+
+// changed marks the source dirty and notifies the loader.
+func (es *etcdSource) changed(notify func()) {
+	es.Lock()
+	es.dirty = true
+	es.Unlock()
+	debounceNotify(&es.pending, notify)
+}
+
+func (es *etcdSource) Health() error {
+	es.RLock()
+	defer es.RUnlock()
+	return es.err
+}
+
+func (es *etcdSource) Close() error {
+	return es.closer.Close()
+}
+
+func (es *etcdSource) String() string {
+	return redactURL(es.uri)
+}
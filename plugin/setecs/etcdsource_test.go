@@ -0,0 +1,223 @@
+package setecs
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd is an in-memory etcd keyspace serving range reads and watches.
+// It keeps the events since the last compaction, so that a watch starting
+// from a revision replays them, or fails with ErrCompacted when the revision
+// was compacted.
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Watcher
+	sync.Mutex
+	revision  int64
+	compacted int64
+	kvs       map[string]string
+	history   []*clientv3.Event
+	watches   map[chan clientv3.WatchResponse]fakeRange
+}
+
+// fakeRange is the key range of a request, [key, end) or key alone.
+type fakeRange struct {
+	key, end string
+}
+
+func newFakeRange(key string, op clientv3.Op) fakeRange {
+	return fakeRange{key: key, end: string(op.RangeBytes())}
+}
+
+func (r fakeRange) contains(key string) bool {
+	if r.end == "" {
+		return key == r.key
+	}
+	return key >= r.key && key < r.end
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]string), watches: make(map[chan clientv3.WatchResponse]fakeRange)}
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	r := newFakeRange(key, clientv3.OpGet(key, opts...))
+	f.Lock()
+	defer f.Unlock()
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: f.revision}}
+	for key, value := range f.kvs {
+		if r.contains(key) {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	return resp, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	r := newFakeRange(key, op)
+	ch := make(chan clientv3.WatchResponse, 64)
+	f.Lock()
+	defer f.Unlock()
+	if from := op.Rev(); from > 0 && from <= f.compacted {
+		ch <- clientv3.WatchResponse{CompactRevision: f.compacted, Canceled: true}
+		close(ch)
+		return ch
+	}
+	ch <- clientv3.WatchResponse{Created: true}
+	for _, ev := range f.history {
+		if op.Rev() > 0 && ev.Kv.ModRevision >= op.Rev() && r.contains(string(ev.Kv.Key)) {
+			ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: ev.Kv.ModRevision}, Events: []*clientv3.Event{ev}}
+		}
+	}
+	f.watches[ch] = r
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		defer f.Unlock()
+		if _, ok := f.watches[ch]; ok {
+			delete(f.watches, ch)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+func (f *fakeEtcd) Close() error { return nil }
+
+// update stores or, with a nil value, deletes a key and notifies the watches.
+func (f *fakeEtcd) update(key string, value *string) {
+	f.Lock()
+	defer f.Unlock()
+	f.revision++
+	ev := &clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: f.revision}}
+	if value == nil {
+		delete(f.kvs, key)
+		ev.Type = clientv3.EventTypeDelete
+	} else {
+		f.kvs[key] = *value
+		ev.Kv.Value = []byte(*value)
+	}
+	f.history = append(f.history, ev)
+	for ch, r := range f.watches {
+		if r.contains(key) {
+			ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: f.revision}, Events: []*clientv3.Event{ev}}
+		}
+	}
+}
+
+func (f *fakeEtcd) put(key, value string) { f.update(key, &value) }
+func (f *fakeEtcd) delete(key string)     { f.update(key, nil) }
+
+// compact drops the events up to the current revision.
+func (f *fakeEtcd) compact() {
+	f.Lock()
+	defer f.Unlock()
+	f.compacted = f.revision
+	f.history = nil
+}
+
+// disconnect ends all watch streams, as a lost connection does.
+func (f *fakeEtcd) disconnect() {
+	f.Lock()
+	defer f.Unlock()
+	for ch := range f.watches {
+		delete(f.watches, ch)
+		close(ch)
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcd.put("/setecs/table/10.0.0.1", "1.1.1.1")
+	etcd.put("/setecs/clients/10.1.0.0/16", "")
+	etcd.put("/setecs/tables/10.0.0.9", "9.9.9.9") // outside of the prefix
+
+	se := NewSetEcs()
+	opts := newSourceOptions()
+	opts.guard.rejectEmpty = true
+	se.addEcsTable(newEcsTable(newEtcdClientSource("etcd://fake/setecs/table", "/setecs/table/", etcd, etcd, etcd), "etcd://fake/setecs/table", opts))
+	se.addEcsBinding(newEcsBinding(net.ParseIP("8.8.8.8"), newEtcdClientSource("etcd://fake/setecs/clients", "/setecs/clients/", etcd, etcd, etcd), "etcd://fake/setecs/clients", nil))
+	se.initialLoad()
+	if ip := se.MatchEcsTable("10.0.0.1"); !ip.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("expected table entry, got %v", ip)
+	}
+	if ip := se.MatchEcsTable("10.0.0.9"); ip != nil {
+		t.Fatalf("key outside of the prefix matched %v", ip)
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.1.2.3")); !ip.Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expected binding entry, got %v", ip)
+	}
+	loader := se.ecsTables[0].loader
+	first := loader.Status().Revision
+	if first != 3 {
+		t.Fatalf("expected revision 3 in the status, got %d", first)
+	}
+
+	if err := se.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer se.OnShutdown()
+	source := loader.source.(*etcdSource)
+	waitFor(t, "watch", func() bool {
+		source.RLock()
+		defer source.RUnlock()
+		return source.watching
+	})
+
+	// the reload ticker is disabled, updates arrive through the watch
+	etcd.put("/setecs/table/10.0.0.1", "2.2.2.2")
+	waitFor(t, "table update", func() bool {
+		return se.MatchEcsTable("10.0.0.1").Equal(net.ParseIP("2.2.2.2"))
+	})
+	if got := loader.Status().Revision; got != 4 {
+		t.Fatalf("expected revision 4, got %d", got)
+	}
+
+	// a rejected read does not move the revision of the content in use
+	etcd.delete("/setecs/table/10.0.0.1")
+	waitFor(t, "rejected update", func() bool {
+		return loader.Status().LastError != ""
+	})
+	if status := loader.Status(); status.Revision != 4 || !se.MatchEcsTable("10.0.0.1").Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("expected revision 4 to stay in use, got %+v", status)
+	}
+
+	// a new watch resumes after the revision of the last read
+	watching := func() bool {
+		source.RLock()
+		defer source.RUnlock()
+		return source.watching
+	}
+	etcd.disconnect()
+	waitFor(t, "disconnect", func() bool { return !watching() })
+	etcd.put("/setecs/table/10.0.0.1", "3.3.3.3")
+	waitFor(t, "resumed watch", func() bool {
+		return se.MatchEcsTable("10.0.0.1").Equal(net.ParseIP("3.3.3.3"))
+	})
+	if got := loader.Status().Revision; got != 6 {
+		t.Fatalf("expected revision 6, got %d", got)
+	}
+
+	// the revisions since the last read are compacted, the prefix is read again
+	etcd.disconnect()
+	waitFor(t, "disconnect", func() bool { return !watching() })
+	etcd.put("/setecs/table/10.0.0.1", "4.4.4.4")
+	etcd.compact()
+	waitFor(t, "read after compaction", func() bool {
+		return se.MatchEcsTable("10.0.0.1").Equal(net.ParseIP("4.4.4.4"))
+	})
+	waitFor(t, "watch after compaction", watching)
+	etcd.put("/setecs/table/10.0.0.1", "5.5.5.5")
+	waitFor(t, "update after compaction", func() bool {
+		return se.MatchEcsTable("10.0.0.1").Equal(net.ParseIP("5.5.5.5"))
+	})
+}
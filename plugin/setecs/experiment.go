@@ -0,0 +1,135 @@
+package setecs
+
+import (
+	"hash/fnv"
+	"net"
+	"strconv"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+// experiment splits the clients with a match into arms, each deriving the
+// ECS option its own way, enabled by the experiment directive:
+//
+//	experiment steering {
+//	    arm control 50
+//	    arm wide 25 prefix 20
+//	    arm pop-b 25 ecs 9.9.9.9
+//	}
+type experiment struct {
+	name  string
+	arms  []*experimentArm
+	total int // sum of the weights
+}
+
+// experimentArm derives the ECS option of its clients: the ecs address of
+// the match, or ecs when set, announced with the prefix lengths.
+type experimentArm struct {
+	name    string
+	weight  int
+	prefix4 uint8
+	prefix6 uint8
+	ecs     net.IP
+}
+
+func parseExperiment(c *caddy.Controller) (*experiment, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.Errf("format is `experiment <name> { arm <name> <weight> [prefix <len>] [prefix6 <len>] [ecs <addr>] ... }`")
+	}
+	ex := &experiment{name: args[0]}
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.Errf("experiment %s needs a block of arms", ex.name)
+	}
+	names := make(map[string]bool)
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		if c.Val() != "arm" {
+			return nil, c.Errf("unknown experiment option '%s'", c.Val())
+		}
+		arm, err := parseExperimentArm(c, c.RemainingArgs())
+		if err != nil {
+			return nil, err
+		}
+		if names[arm.name] {
+			return nil, c.Errf("duplicate experiment arm '%s'", arm.name)
+		}
+		names[arm.name] = true
+		ex.arms = append(ex.arms, arm)
+		ex.total += arm.weight
+	}
+	if len(ex.arms) < 2 {
+		return nil, c.Errf("experiment %s needs at least two arms", ex.name)
+	}
+	return ex, nil
+}
+
+func parseExperimentArm(c *caddy.Controller, args []string) (*experimentArm, error) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return nil, c.Errf("format is `arm <name> <weight> [prefix <len>] [prefix6 <len>] [ecs <addr>]`")
+	}
+	weight, err := strconv.Atoi(args[1])
+	if err != nil || weight <= 0 {
+		return nil, c.Errf("invalid weight '%s' of arm %s", args[1], args[0])
+	}
+	arm := &experimentArm{name: args[0], weight: weight, prefix4: 24, prefix6: 48}
+	for i := 2; i < len(args); i += 2 {
+		switch args[i] {
+		case "prefix", "prefix6":
+			max := 32
+			if args[i] == "prefix6" {
+				max = 128
+			}
+			v, err := strconv.Atoi(args[i+1])
+			if err != nil || v <= 0 || v > max {
+				return nil, c.Errf("invalid %s '%s' of arm %s", args[i], args[i+1], arm.name)
+			}
+			if args[i] == "prefix" {
+				arm.prefix4 = uint8(v)
+			} else {
+				arm.prefix6 = uint8(v)
+			}
+		case "ecs":
+			arm.ecs = net.ParseIP(args[i+1])
+			if arm.ecs == nil {
+				return nil, c.Errf("invalid ecs address '%s' of arm %s", args[i+1], arm.name)
+			}
+		default:
+			return nil, c.Errf("unknown arm option '%s'", args[i])
+		}
+	}
+	return arm, nil
+}
+
+// arm returns the arm of a client, the same on every instance.
+func (ex *experiment) arm(client net.IP) *experimentArm {
+	if ex == nil {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ex.name))
+	h.Write(client.To16())
+	bucket := int(h.Sum32() % uint32(ex.total))
+	for _, arm := range ex.arms {
+		if bucket < arm.weight {
+			return arm
+		}
+		bucket -= arm.weight
+	}
+	return ex.arms[len(ex.arms)-1]
+}
+
+// derive returns the ecs address and option of the arm for the ecs address
+// of a match.
+func (arm *experimentArm) derive(ecsip net.IP) (net.IP, *dns.EDNS0_SUBNET) {
+	if arm.ecs != nil {
+		ecsip = arm.ecs
+	}
+	if ip4 := ecsip.To4(); ip4 != nil {
+		return ecsip, newEDNS0Subnet(ip4, arm.prefix4, false)
+	}
+	return ecsip, newEDNS0Subnet(ecsip.To16(), arm.prefix6, true)
+}
@@ -0,0 +1,240 @@
+package setecs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/c-robinson/iplib"
+)
+
+// Match is a table entry or binding prefix containing a client.
+type Match struct {
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Ecs    string `json:"ecs"`
+	Entry  string `json:"entry"`            // the client or prefix as listed in the source
+	Line   int    `json:"line,omitempty"`   // line of the entry in the source
+	Shadow bool   `json:"shadow,omitempty"` // from a source in shadow mode, never applied
+}
+
+// Explanation describes the ECS decision for a client: the entry that wins
+// and the entries of later tables and bindings it shadows.
+type Explanation struct {
+	Client   string  `json:"client"`
+	Subnet   string  `json:"subnet,omitempty"` // the ECS option set on queries
+	Arm      string  `json:"arm,omitempty"`    // the experiment arm deriving the subnet
+	Match    *Match  `json:"match,omitempty"`
+	Shadowed []Match `json:"shadowed,omitempty"`
+}
+
+// Explain returns the decision for a client, following the order of
+// ServeDNS: single addresses of the tables, CIDR clients of the tables, then
+// bindings, each in Corefile order, and default-ecs without a match. Entries
+// of sources in shadow mode never win and are listed as shadowed.
+func (se *SetEcs) Explain(client net.IP) Explanation {
+	matches := make([]Match, 0)
+	se.ecsTablesLock.RLock()
+	for _, table := range se.ecsTables {
+		if ecsip, ok := table.lookup(client.String()); ok {
+			matches = append(matches, Match{
+				Kind:   "ecs-table",
+				Source: table.sourceName(),
+				Ecs:    ecsip.String(),
+				Entry:  client.String(),
+				Line:   table.line(client.String()),
+				Shadow: se.inShadow(table.loader),
+			})
+		}
+	}
+	for _, table := range se.ecsTables {
+		if entry, ecsip, ok := table.lookupNet(client); ok {
+			matches = append(matches, Match{
+				Kind:   "ecs-table",
+				Source: table.sourceName(),
+				Ecs:    ecsip.String(),
+				Entry:  entry,
+				Line:   table.line(entry),
+				Shadow: se.inShadow(table.loader),
+			})
+		}
+	}
+	se.ecsTablesLock.RUnlock()
+	se.ecsBindingsLock.RLock()
+	for _, binding := range se.ecsBindings {
+		if !binding.existIp(client) {
+			continue
+		}
+		m := Match{Kind: "ecs-binding", Source: binding.sourceName(), Ecs: binding.ecsip.String(), Shadow: se.inShadow(binding.loader)}
+		if o := binding.origin(client); o != nil {
+			m.Entry, m.Line = o.net.String(), o.line
+		}
+		matches = append(matches, m)
+	}
+	se.ecsBindingsLock.RUnlock()
+
+	e := Explanation{Client: client.String()}
+	for i := range matches {
+		if e.Match == nil && !matches[i].Shadow {
+			e.Match = &matches[i]
+		} else {
+			e.Shadowed = append(e.Shadowed, matches[i])
+		}
+	}
+	ecsip := se.defaultEcs
+	if e.Match != nil {
+		ecsip = net.ParseIP(e.Match.Ecs)
+	}
+	if ecsip == nil {
+		return e
+	}
+	if arm := se.experiment.arm(client); arm != nil {
+		e.Arm = arm.name
+		_, ecs := arm.derive(ecsip)
+		e.Subnet = ecsSubnet(ecs)
+		return e
+	}
+	e.Subnet = ecsSubnet(ecsOption(ecsip))
+	return e
+}
+
+// DumpTable is the effective content of an ecs-table.
+type DumpTable struct {
+	Source  string            `json:"source"`
+	Entries map[string]string `json:"entries"`
+}
+
+// Snapshots of a binding reported by Dump and Sources.
+const (
+	snapshotStable = "stable" // served to all clients
+	snapshotCanary = "canary" // served to the canary share of the clients
+)
+
+// DumpBinding is the effective content of an ecs-binding. A binding with a
+// canary in progress is dumped twice, the stable snapshot followed by the
+// canary.
+type DumpBinding struct {
+	Source   string   `json:"source"`
+	Ecs      string   `json:"ecs"`
+	Snapshot string   `json:"snapshot"`
+	Percent  int      `json:"percent,omitempty"` // share of the clients served by a canary
+	Clients  []string `json:"clients"`
+}
+
+// Dump is the effective mapping, tables and bindings in the order they are
+// consulted.
+type Dump struct {
+	Tables   []DumpTable   `json:"tables"`
+	Bindings []DumpBinding `json:"bindings"`
+}
+
+// Dump returns the mapping in use.
+func (se *SetEcs) Dump() Dump {
+	d := Dump{Tables: make([]DumpTable, 0), Bindings: make([]DumpBinding, 0)}
+	se.ecsTablesLock.RLock()
+	for _, table := range se.ecsTables {
+		entries := make(map[string]string)
+		table.RLock()
+		for client, ecs := range table.dict {
+			entries[client] = ecs.String()
+		}
+		table.RUnlock()
+		d.Tables = append(d.Tables, DumpTable{Source: table.sourceName(), Entries: entries})
+	}
+	se.ecsTablesLock.RUnlock()
+	se.ecsBindingsLock.RLock()
+	for _, binding := range se.ecsBindings {
+		rollout := binding.canaryRollout()
+		binding.RLock()
+		d.Bindings = append(d.Bindings, DumpBinding{
+			Source: binding.sourceName(), Ecs: binding.ecsip.String(), Snapshot: snapshotStable, Clients: netStrings(binding.clients),
+		})
+		if c := binding.canary; c != nil {
+			d.Bindings = append(d.Bindings, DumpBinding{
+				Source: binding.sourceName(), Ecs: binding.ecsip.String(), Snapshot: snapshotCanary, Percent: rollout.percent, Clients: netStrings(c.clients),
+			})
+		}
+		binding.RUnlock()
+	}
+	se.ecsBindingsLock.RUnlock()
+	return d
+}
+
+func netStrings(nets []iplib.Net) []string {
+	result := make([]string, 0, len(nets))
+	for _, n := range nets {
+		result = append(result, n.String())
+	}
+	return result
+}
+
+// Text renders the dump as `client ecs` lines, each table and binding
+// introduced by a comment naming it.
+func (d Dump) Text() string {
+	var lines []string
+	for _, t := range d.Tables {
+		lines = append(lines, fmt.Sprintf("# ecs-table %s", t.Source))
+		clients := make([]string, 0, len(t.Entries))
+		for client := range t.Entries {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			lines = append(lines, client+" "+t.Entries[client])
+		}
+	}
+	for _, b := range d.Bindings {
+		if b.Snapshot == snapshotCanary {
+			lines = append(lines, fmt.Sprintf("# ecs-binding %s %s canary %d%%", b.Ecs, b.Source, b.Percent))
+		} else {
+			lines = append(lines, fmt.Sprintf("# ecs-binding %s %s", b.Ecs, b.Source))
+		}
+		for _, client := range b.Clients {
+			lines = append(lines, client+" "+b.Ecs)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// SourceReport is the state of a source as reported by the admin api. The
+// status describes the last version loaded, which is the canary snapshot of
+// a binding while a canary is in progress.
+type SourceReport struct {
+	SourceStatus
+	Kind          string       `json:"kind"`
+	Ecs           string       `json:"ecs,omitempty"`
+	Snapshot      string       `json:"snapshot"`
+	StableEntries int          `json:"stable_entries,omitempty"` // entries served to the other clients during a canary
+	Health        string       `json:"health,omitempty"`
+	Diagnostics   []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// Sources returns the state of every source, tables first.
+func (se *SetEcs) Sources() []SourceReport {
+	reports := make([]SourceReport, 0)
+	add := func(l *sourceLoader, kind, ecs string) *SourceReport {
+		r := SourceReport{SourceStatus: l.Status(), Kind: kind, Ecs: ecs, Snapshot: snapshotStable, Diagnostics: l.Diagnostics()}
+		if err := l.source.Health(); err != nil {
+			r.Health = err.Error()
+		}
+		reports = append(reports, r)
+		return &reports[len(reports)-1]
+	}
+	se.ecsTablesLock.RLock()
+	for _, table := range se.ecsTables {
+		add(table.loader, "ecs-table", "")
+	}
+	se.ecsTablesLock.RUnlock()
+	se.ecsBindingsLock.RLock()
+	for _, binding := range se.ecsBindings {
+		r := add(binding.loader, "ecs-binding", binding.ecsip.String())
+		binding.RLock()
+		if binding.canary != nil {
+			r.Snapshot, r.StableEntries = snapshotCanary, len(binding.clients)
+		}
+		binding.RUnlock()
+	}
+	se.ecsBindingsLock.RUnlock()
+	return reports
+}
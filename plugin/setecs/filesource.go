@@ -0,0 +1,90 @@
+package setecs
+
+import (
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("file", func(u *neturl.URL, opts *SourceOptions) (Source, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path")
+		}
+		return newFileSource(u.Path, opts), nil
+	})
+}
+
+// fileSource reads a list from a local file, it changes when the
+// modification time or the size of the file changes.
+type fileSource struct {
+	sync.RWMutex
+	path  string
+	opts  *SourceOptions
+	mtime time.Time
+	size  int64
+	err   error
+}
+
+func newFileSource(path string, opts *SourceOptions) *fileSource {
+	return &fileSource{path: path, opts: opts}
+}
+
+func (fs *fileSource) local() {}
+
+func (fs *fileSource) Changed() bool {
+	stat, err := os.Stat(fs.path)
+	if err != nil {
+		// let Load report the error
+		return true
+	}
+	fs.RLock()
+	defer fs.RUnlock()
+	return stat.ModTime() != fs.mtime || stat.Size() != fs.size
+}
+
+func (fs *fileSource) Load() ([]byte, error) {
+	content, stat, err := fs.read()
+	fs.Lock()
+	defer fs.Unlock()
+	fs.err = err
+	if err != nil {
+		return nil, err
+	}
+	fs.mtime = stat.ModTime()
+	fs.size = stat.Size()
+	return content, nil
+}
+
+func (fs *fileSource) read() ([]byte, os.FileInfo, error) {
+	file, err := os.Open(fs.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fs.opts.verifyFile(fs.path, content); err != nil {
+		return nil, nil, fmt.Errorf("signature verification failed: %v", err)
+	}
+	return content, stat, nil
+}
+
+func (fs *fileSource) Health() error {
+	fs.RLock()
+	defer fs.RUnlock()
+	return fs.err
+}
+
+func (fs *fileSource) String() string {
+	return fs.path
+}
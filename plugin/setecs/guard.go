@@ -0,0 +1,94 @@
+package setecs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// reloadGuard holds the per-source limits a reload must pass before its
+// result replaces the previous snapshot.
+type reloadGuard struct {
+	maxShrink   float64 // fraction of entries a reload may drop, 0 disables
+	maxErrors   int     // lines that may fail to parse, -1 disables
+	rejectEmpty bool
+}
+
+func newReloadGuard() reloadGuard {
+	return reloadGuard{maxErrors: -1}
+}
+
+// parseGuardOption handles the guard options of a source block, it returns
+// false when name is not a guard option.
+func (g *reloadGuard) parseGuardOption(c *caddy.Controller, name string, args []string) (bool, error) {
+	switch name {
+	case "max-shrink":
+		if len(args) != 1 {
+			return true, c.Errf("format is `max-shrink <percent>`")
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+		if err != nil || v <= 0 || v > 100 {
+			return true, c.Errf("invalid max-shrink '%s'", args[0])
+		}
+		g.maxShrink = v / 100
+	case "max-errors":
+		if len(args) != 1 {
+			return true, c.Errf("format is `max-errors <lines>`")
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 0 {
+			return true, c.Errf("invalid max-errors '%s'", args[0])
+		}
+		g.maxErrors = v
+	case "reject-empty":
+		g.rejectEmpty = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// check returns the reason a reload from prev to next entries with errs
+// unparsable lines is rejected, or the empty string.
+func (g reloadGuard) check(prev, next, errs int) string {
+	switch {
+	case g.rejectEmpty && next == 0:
+		return "empty"
+	case g.maxErrors >= 0 && errs > g.maxErrors:
+		return "parse_errors"
+	case g.maxShrink > 0 && prev > 0 && float64(prev-next) > float64(prev)*g.maxShrink:
+		return "shrink"
+	}
+	return ""
+}
+
+func (g reloadGuard) String() string {
+	var parts []string
+	if g.maxShrink > 0 {
+		parts = append(parts, fmt.Sprintf("max-shrink=%g%%", g.maxShrink*100))
+	}
+	if g.maxErrors >= 0 {
+		parts = append(parts, fmt.Sprintf("max-errors=%d", g.maxErrors))
+	}
+	if g.rejectEmpty {
+		parts = append(parts, "reject-empty")
+	}
+	return strings.Join(parts, ",")
+}
+
+// guardReload applies the guard of a source and reports a rejection.
+func (o *SourceOptions) guardReload(source string, prev, next, errs int) bool {
+	if o == nil {
+		return true
+	}
+	reason := o.guard.check(prev, next, errs)
+	if reason == "" {
+		return true
+	}
+	log.Errorf("Reload of %s rejected (%s): entries %d -> %d, parse errors %d, keeping previous snapshot",
+		source, reason, prev, next, errs)
+	reloadRejected.WithLabelValues(source, reason).Inc()
+	return false
+}
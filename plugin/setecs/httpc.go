@@ -3,15 +3,189 @@ package setecs
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 type H map[string]string
 
+// defaultMaxSize caps the body of a response unless a source sets max-size.
+const defaultMaxSize = 64 << 20
+
+var (
+	transportsLock sync.Mutex
+	// transports are shared by every source with the same tls settings so
+	// that connections are kept alive across reloads.
+	transports       = make(map[string]*sharedTransport)
+	defaultTransport = newTransport(nil, nil)
+)
+
+// sharedTransport is a transport with the state of the tls files it was
+// built from, it is rebuilt when a file is rotated.
+type sharedTransport struct {
+	transport *http.Transport
+	files     string
+}
+
+func newTransport(tlsConfig *tls.Config, proxy func(*http.Request) (*neturl.URL, error)) *http.Transport {
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// parsePin decodes a `sha256//<base64>` (or bare base64) SPKI hash.
+func parsePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(pin, "sha256//")
+	b, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("pin must be a sha256 hash, got %d bytes", len(b))
+	}
+	return b, nil
+}
+
+func (o *SourceOptions) transportKey() string {
+	return strings.Join([]string{
+		o.tlsCA, o.tlsCert, o.tlsKey, strings.Join(o.tlsPins, ","), fmt.Sprint(o.insecure), o.proxy,
+	}, "|")
+}
+
+// tlsFiles describes the modification time and size of the tls files.
+func (o *SourceOptions) tlsFiles() string {
+	var parts []string
+	for _, path := range []string{o.tlsCA, o.tlsCert, o.tlsKey} {
+		if path == "" {
+			continue
+		}
+		if stat, err := os.Stat(path); err == nil {
+			parts = append(parts, fmt.Sprintf("%d/%d", stat.ModTime().UnixNano(), stat.Size()))
+		} else {
+			parts = append(parts, "-")
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+func (o *SourceOptions) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: o.insecure}
+	if o.tlsCA != "" {
+		pem, err := ioutil.ReadFile(o.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.tlsCA)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.tlsCert, o.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.tlsPins) > 0 {
+		pins := make([][]byte, 0, len(o.tlsPins))
+		for _, p := range o.tlsPins {
+			b, err := parsePin(p)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, b)
+		}
+		// VerifyConnection also runs when InsecureSkipVerify is set, so a pin
+		// is enforced even for sources that opt out of chain verification.
+		// The certificates sent by the server are not trusted as such: the
+		// pin must be in a verified chain, or be the leaf when chains are not
+		// verified.
+		insecure := o.insecure
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			var certs []*x509.Certificate
+			if insecure {
+				if len(cs.PeerCertificates) > 0 {
+					certs = cs.PeerCertificates[:1]
+				}
+			} else {
+				for _, chain := range cs.VerifiedChains {
+					certs = append(certs, chain...)
+				}
+			}
+			for _, cert := range certs {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no peer certificate matches the pinned public key")
+		}
+	}
+	return cfg, nil
+}
+
+// httpClient returns a client using a transport shared by all sources
+// with the same tls settings, rebuilt when a tls file changes.
+func (o *SourceOptions) httpClient() (*http.Client, error) {
+	if o == nil || o.transportKey() == newSourceOptions().transportKey() {
+		return &http.Client{Transport: defaultTransport}, nil
+	}
+	key := o.transportKey()
+	files := o.tlsFiles()
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	shared, ok := transports[key]
+	if !ok || shared.files != files {
+		cfg, err := o.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		var proxy func(*http.Request) (*neturl.URL, error)
+		if o.proxy != "" {
+			proxyURL, err := neturl.Parse(o.proxy)
+			if err != nil {
+				return nil, err
+			}
+			proxy = http.ProxyURL(proxyURL)
+		}
+		if ok {
+			shared.transport.CloseIdleConnections()
+		}
+		shared = &sharedTransport{transport: newTransport(cfg, proxy), files: files}
+		transports[key] = shared
+	}
+	return &http.Client{Transport: shared.transport}, nil
+}
+
 func HttpGet(url string, header H) (respBytes []byte, err error) {
 	return HttpRequest(http.MethodGet, url, nil, header)
 }
@@ -21,6 +195,16 @@ func HttpPost(url string, body io.Reader, header H) (respBytes []byte, err error
 }
 
 func HttpRequest(method, url string, body io.Reader, header map[string]string) (respBytes []byte, err error) {
+	return HttpRequestWithClient(&http.Client{Transport: defaultTransport}, method, url, body, header)
+}
+
+func HttpRequestWithClient(client *http.Client, method, url string, body io.Reader, header map[string]string) (respBytes []byte, err error) {
+	return httpRequestLimit(client, method, url, body, header, defaultMaxSize)
+}
+
+// httpRequestLimit is HttpRequestWithClient failing when the response body
+// holds more than limit bytes or is cut short.
+func httpRequestLimit(client *http.Client, method, url string, body io.Reader, header map[string]string, limit int64) (respBytes []byte, err error) {
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFunc()
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
@@ -33,20 +217,38 @@ func HttpRequest(method, url string, body io.Reader, header map[string]string) (
 		}
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := http.Client{Transport: tr}
 	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
-	buffer := bytes.Buffer{}
-	io.Copy(&buffer, resp.Body)
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("http response status is %d for url  %s", resp.StatusCode, url)
+		return nil, fmt.Errorf("http response status is %d for url  %s", resp.StatusCode, redactURL(url))
+	}
+	buffer := bytes.Buffer{}
+	if _, err := io.Copy(&buffer, io.LimitReader(resp.Body, limit+1)); err != nil {
+		return nil, fmt.Errorf("reading response of %s: %v", redactURL(url), err)
+	}
+	if int64(buffer.Len()) > limit {
+		return nil, fmt.Errorf("response of %s exceeds %d bytes", redactURL(url), limit)
 	}
 	return buffer.Bytes(), nil
 }
+
+// fetch downloads a source url using the tls and auth settings of the source.
+func (o *SourceOptions) fetch(url string) ([]byte, error) {
+	client, err := o.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	header, err := o.requestHeader()
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(defaultMaxSize)
+	if o != nil && o.maxSize > 0 {
+		limit = o.maxSize
+	}
+	return httpRequestLimit(client, http.MethodGet, url, nil, header, limit)
+}
@@ -0,0 +1,121 @@
+package setecs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for 127.0.0.1 and its pin.
+func testCert(t *testing.T, name string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+		"sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTlsPin(t *testing.T) {
+	leaf, leafPin := testCert(t, "leaf")
+	pinnedCert, pinned := testCert(t, "pinned")
+	// the server presents its own leaf followed by a copy of the pinned
+	// certificate
+	chain := leaf
+	chain.Certificate = [][]byte{leaf.Certificate[0], pinnedCert.Certificate[0]}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("10.0.0.0/8\n"))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{chain}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		insecure bool
+		pin      string
+		ok       bool
+	}{
+		{true, pinned, false},
+		{true, leafPin, true},
+		{false, pinned, false},
+		{false, leafPin, true},
+	} {
+		opts := newSourceOptions()
+		opts.insecure = c.insecure
+		if !c.insecure {
+			opts.tlsCA = ca
+		}
+		opts.tlsPins = []string{c.pin}
+		_, err := opts.fetch(srv.URL)
+		if (err == nil) != c.ok {
+			t.Errorf("insecure %v, pin of the leaf %v: unexpected error %v", c.insecure, c.pin == leafPin, err)
+		}
+	}
+}
+
+func TestFetchLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write(bytes.Repeat([]byte("10.0.0.0/24\n"), 100000))
+		case "/short":
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("10.0.0.0/24\n"))
+		default:
+			w.Write([]byte("10.0.0.0/24\n"))
+		}
+	}))
+	defer srv.Close()
+
+	opts := newSourceOptions()
+	opts.maxSize = 1 << 20
+	for path, ok := range map[string]bool{"/": true, "/large": false, "/short": false} {
+		if _, err := opts.fetch(srv.URL + path); (err == nil) != ok {
+			t.Errorf("%s: unexpected error %v", path, err)
+		}
+	}
+	if _, err := newSourceOptions().fetch(srv.URL + "/large"); err != nil {
+		t.Errorf("default max-size: unexpected error %v", err)
+	}
+}
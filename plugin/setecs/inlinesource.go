@@ -0,0 +1,57 @@
+package setecs
+
+import (
+	"strings"
+	"sync"
+)
+
+// inlineSource holds the CIDRs listed directly on an ecs-binding line and the
+// entries pushed through the admin api.
+type inlineSource struct {
+	sync.RWMutex
+	entries []string
+	dirty   bool
+}
+
+func newInlineSource() *inlineSource {
+	return &inlineSource{entries: make([]string, 0)}
+}
+
+func (is *inlineSource) local() {}
+
+func (is *inlineSource) add(entry string) {
+	is.Lock()
+	defer is.Unlock()
+	is.entries = append(is.entries, entry)
+	is.dirty = true
+}
+
+func (is *inlineSource) list() []string {
+	is.RLock()
+	defer is.RUnlock()
+	return append([]string{}, is.entries...)
+}
+
+func (is *inlineSource) set(entries []string) {
+	is.Lock()
+	defer is.Unlock()
+	is.entries = entries
+	is.dirty = true
+}
+
+func (is *inlineSource) Changed() bool {
+	is.RLock()
+	defer is.RUnlock()
+	return is.dirty
+}
+
+func (is *inlineSource) Load() ([]byte, error) {
+	is.Lock()
+	defer is.Unlock()
+	is.dirty = false
+	return []byte(strings.Join(is.entries, "\n")), nil
+}
+
+func (is *inlineSource) Health() error { return nil }
+
+func (is *inlineSource) String() string { return "inline" }
@@ -0,0 +1,135 @@
+package setecs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ecsDecision is the outcome of the lookup of a client.
+type ecsDecision struct {
+	action    string            // one of the decision constants
+	source    string            // the table or binding that matched
+	binding   string            // the ecs address of the matching binding
+	ecsip     net.IP            // the ecs address, nil without a match
+	matched   net.IP            // the ecs address of the match, before the experiment arm
+	ecs       *dns.EDNS0_SUBNET // the option to set, nil without a match
+	clientEcs *dns.EDNS0_SUBNET // the option sent by the client
+	shadow    *ecsDecision      // the decision including the shadow sources
+	arm       string            // the experiment arm that derived the option
+}
+
+// agrees reports whether the shadow decision matches the same ecs address.
+// The addresses are compared before the experiment arm derives them, which
+// may replace both with the same address.
+func (d *ecsDecision) agrees() bool {
+	return d.shadow == nil || d.matched.Equal(d.shadow.matched)
+}
+
+// decide looks up the ecs address of a client, and the shadow decision when
+// sources are in shadow mode.
+func (se *SetEcs) decide(state request.Request, client net.IP) *ecsDecision {
+	start := time.Now()
+	clientEcs := getMsgECS(state.Req)
+	d := se.lookup(state.IP(), client, clientEcs, false)
+	if se.hasShadow {
+		d.shadow = se.lookup(state.IP(), client, clientEcs, true)
+	}
+	if arm := se.experiment.arm(client); arm != nil {
+		// the shadow decision is derived by the same arm
+		for _, d := range []*ecsDecision{d, d.shadow} {
+			if d != nil && d.ecsip != nil {
+				d.arm = arm.name
+				d.ecsip, d.ecs = arm.derive(d.ecsip)
+			}
+		}
+	}
+	lookupDuration.Observe(time.Since(start).Seconds())
+	return d
+}
+
+// lookup finds the ecs address of a client: ecs-table entries take
+// precedence over ecs-binding, then default-ecs applies. Without any, the
+// ECS option of the client is stripped or kept.
+func (se *SetEcs) lookup(ipstr string, client net.IP, clientEcs *dns.EDNS0_SUBNET, withShadow bool) *ecsDecision {
+	d := &ecsDecision{action: decisionNone, clientEcs: clientEcs}
+	if ecsip, table := se.matchTable(ipstr, withShadow); ecsip != nil {
+		d.action, d.source, d.ecsip = decisionTable, table.sourceName(), ecsip
+	} else if bind := se.matchBinding(client, withShadow); bind != nil {
+		d.action, d.source, d.ecsip = decisionBinding, bind.sourceName(), bind.ecsip
+		d.binding = bind.ecsip.String()
+	} else if se.defaultEcs != nil {
+		d.action, d.ecsip = decisionDefault, se.defaultEcs
+	} else if clientEcs != nil && se.stripClientEcs {
+		d.action = decisionStrip
+	} else if clientEcs != nil {
+		d.action = decisionKeptClientEcs
+	}
+	d.matched = d.ecsip
+	d.ecs = ecsOption(d.ecsip)
+	return d
+}
+
+type decisionKey struct{}
+
+// lazyDecision defers the lookup to the first use, by ServeDNS or by a
+// plugin reading the metadata.
+type lazyDecision struct {
+	once     sync.Once
+	req      *dns.Msg
+	decision *ecsDecision
+}
+
+func (l *lazyDecision) get(se *SetEcs, state request.Request, client net.IP) *ecsDecision {
+	l.once.Do(func() {
+		l.decision = se.decide(state, client)
+	})
+	return l.decision
+}
+
+// Metadata implements the metadata.Provider interface, publishing the ECS
+// decision as setecs/action, setecs/ecs, setecs/source, setecs/binding,
+// setecs/client-ecs and setecs/arm.
+func (se *SetEcs) Metadata(ctx context.Context, state request.Request) context.Context {
+	client := net.ParseIP(state.IP())
+	if client == nil {
+		return ctx
+	}
+	lazy := &lazyDecision{req: state.Req}
+	get := func() *ecsDecision { return lazy.get(se, state, client) }
+	metadata.SetValueFunc(ctx, PluginName+"/action", func() string { return get().action })
+	metadata.SetValueFunc(ctx, PluginName+"/ecs", func() string { return ecsSubnet(get().ecs) })
+	metadata.SetValueFunc(ctx, PluginName+"/source", func() string { return get().source })
+	metadata.SetValueFunc(ctx, PluginName+"/binding", func() string { return get().binding })
+	metadata.SetValueFunc(ctx, PluginName+"/client-ecs", func() string { return ecsSubnet(get().clientEcs) })
+	metadata.SetValueFunc(ctx, PluginName+"/arm", func() string { return get().arm })
+	return context.WithValue(ctx, decisionKey{}, lazy)
+}
+
+// decision returns the decision for the query, shared with the metadata
+// when the metadata plugin is enabled.
+func (se *SetEcs) decision(ctx context.Context, state request.Request, client net.IP) *ecsDecision {
+	if lazy, ok := ctx.Value(decisionKey{}).(*lazyDecision); ok && lazy.req == state.Req {
+		return lazy.get(se, state, client)
+	}
+	return se.decide(state, client)
+}
+
+// ecsSubnet renders an ECS option as a masked prefix, e.g. 1.2.3.0/24, or ""
+// for nil.
+func ecsSubnet(ecs *dns.EDNS0_SUBNET) string {
+	if ecs == nil || ecs.Address == nil {
+		return ""
+	}
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+	return fmt.Sprintf("%s/%d", ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits)), ecs.SourceNetmask)
+}
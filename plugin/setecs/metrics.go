@@ -0,0 +1,143 @@
+package setecs
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring.
+var (
+	cacheTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "cache_timestamp_seconds",
+		Help:      "Time the cached copy of a url source was written, the cache age is time() minus this value.",
+	}, []string{"source"})
+	reloadRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "reload_rejected_total",
+		Help:      "Counter of reloads rejected by the source guards.",
+	}, []string{"source", "reason"})
+	queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "queries_total",
+		Help:      "Counter of queries by ECS decision and the table or binding that matched.",
+	}, []string{"decision", "source", "ecs"})
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "reloads_total",
+		Help:      "Counter of reload attempts of the changed sources by result, success or failure.",
+	}, []string{"source", "result"})
+	sourceEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "entries",
+		Help:      "Number of entries loaded from a source.",
+	}, []string{"source"})
+	lastLoad = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "last_load_timestamp_seconds",
+		Help:      "Time of the last successful load of a source.",
+	}, []string{"source"})
+	lookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "lookup_duration_seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10), // 1us to 0.26s
+		Help:      "Histogram of the time spent finding the ECS address of a client.",
+	})
+	upstreamEcs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "upstream_ecs_total",
+		Help:      "Counter of responses to queries with an ECS option set, by echo: valid, missing or invalid.",
+	}, []string{"source", "ecs", "echo"})
+	upstreamScope = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "upstream_ecs_scope_total",
+		Help:      "Counter of valid ECS echoes by scope prefix length.",
+	}, []string{"source", "ecs", "scope"})
+	shadowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "shadow_queries_total",
+		Help:      "Counter of queries by the decision including the shadow sources, which is not applied.",
+	}, []string{"decision", "source", "ecs"})
+	shadowAgreement = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "shadow_agreement_total",
+		Help:      "Counter of queries whose shadow decision agrees or disagrees with the active one.",
+	}, []string{"result"})
+	experimentQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "experiment_queries_total",
+		Help:      "Counter of queries by experiment arm.",
+	}, []string{"experiment", "arm"})
+	experimentResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "experiment_responses_total",
+		Help:      "Counter of upstream responses by experiment arm and rcode.",
+	}, []string{"experiment", "arm", "rcode"})
+	experimentRtt = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "experiment_rtt_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time to the upstream response by experiment arm.",
+	}, []string{"experiment", "arm"})
+	experimentAnswers = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "experiment_answers",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16},
+		Help:      "Histogram of the answer records of upstream responses by experiment arm.",
+	}, []string{"experiment", "arm"})
+	auditDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "audit_dropped_total",
+		Help:      "Counter of audit entries dropped because the buffer was full.",
+	})
+	auditRotateFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "audit_rotate_failures_total",
+		Help:      "Counter of audit log rotations that failed to open the new file.",
+	})
+)
+
+// countDecision counts a decision in queries_total or shadow_queries_total.
+func countDecision(counter *prometheus.CounterVec, d *ecsDecision) {
+	if d.ecsip != nil {
+		counter.WithLabelValues(d.action, d.source, d.ecsip.String()).Inc()
+	} else {
+		counter.WithLabelValues(d.action, "", "").Inc()
+	}
+}
+
+// Decisions reported by queries_total.
+const (
+	decisionTable         = "table"
+	decisionBinding       = "binding"
+	decisionDefault       = "default"         // no match, the default-ecs address is set
+	decisionStrip         = "strip"           // no match, the ECS option of the client is removed
+	decisionKeptClientEcs = "kept-client-ecs" // no match, the ECS option of the client is forwarded
+	decisionNone          = "none"            // no match and no ECS option
+)
+
+// ECS echoes reported by upstream_ecs_total.
+const (
+	echoValid   = "valid"
+	echoMissing = "missing" // upstream ignored the option
+	echoInvalid = "invalid" // family, source prefix length or address differ, RFC 7871 7.3
+)
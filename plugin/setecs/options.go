@@ -0,0 +1,279 @@
+package setecs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// SourceOptions holds the per-source settings declared in the optional block
+// that may follow an ecs-binding or ecs-table line, e.g.
+//
+//	ecs-binding 8.8.8.8 clients https://example.com/clients.txt {
+//	    tls-ca /etc/ssl/internal-ca.pem
+//	}
+type SourceOptions struct {
+	tlsCA    string
+	tlsCert  string
+	tlsKey   string
+	tlsPins  []string
+	insecure bool
+
+	bearerTokenFile string
+	bearerTokenEnv  string
+	basicUser       string
+	basicPass       string
+	headers         H
+	proxy           string
+
+	verifier *signatureVerifier
+	guard    reloadGuard
+	shadow   bool // evaluated next to the active decision, not applied
+	canary   canaryRollout
+	query    string // SQL of a sqlite source, taken verbatim
+	maxSize  int64  // bytes a download may hold, defaultMaxSize when zero
+}
+
+func newSourceOptions() *SourceOptions {
+	return &SourceOptions{
+		tlsPins: make([]string, 0),
+		headers: make(H),
+		guard:   newReloadGuard(),
+	}
+}
+
+// parseSourceOptions consumes an optional `{ ... }` block on the current line.
+// It returns default options when no block is present.
+func parseSourceOptions(c *caddy.Controller) (*SourceOptions, error) {
+	opts := newSourceOptions()
+	if !c.NextArg() {
+		return opts, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.Errf("unexpected token '%s'", c.Val())
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		name := c.Val()
+		args := c.RemainingArgs()
+		switch name {
+		case "tls-ca":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `tls-ca <ca bundle file>`")
+			}
+			opts.tlsCA = args[0]
+		case "tls-cert":
+			if len(args) != 2 {
+				return nil, c.Errf("format is `tls-cert <cert file> <key file>`")
+			}
+			opts.tlsCert = args[0]
+			opts.tlsKey = args[1]
+		case "tls-pin":
+			if len(args) < 1 {
+				return nil, c.Errf("format is `tls-pin <sha256//base64 spki hash>...`")
+			}
+			for _, pin := range args {
+				if _, err := parsePin(pin); err != nil {
+					return nil, c.Errf("invalid tls-pin %s: %s", pin, err.Error())
+				}
+			}
+			opts.tlsPins = append(opts.tlsPins, args...)
+		case "insecure":
+			opts.insecure = true
+		case "shadow":
+			if len(args) != 0 {
+				return nil, c.Errf("format is `shadow`")
+			}
+			opts.shadow = true
+		case "canary":
+			if err := opts.canary.parseCanaryOption(c, args); err != nil {
+				return nil, err
+			}
+		case "query":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `query <sql>`")
+			}
+			opts.query = args[0]
+		case "max-size":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `max-size <MB>`")
+			}
+			mb, err := strconv.Atoi(args[0])
+			if err != nil || mb <= 0 {
+				return nil, c.Errf("invalid max-size '%s'", args[0])
+			}
+			opts.maxSize = int64(mb) << 20
+		case "bearer-token-file":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `bearer-token-file <file>`")
+			}
+			opts.bearerTokenFile = args[0]
+		case "bearer-token-env":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `bearer-token-env <variable>`")
+			}
+			opts.bearerTokenEnv = args[0]
+		case "basic-auth":
+			if len(args) != 2 {
+				return nil, c.Errf("format is `basic-auth <user> <password>`")
+			}
+			opts.basicUser = args[0]
+			opts.basicPass = args[1]
+		case "header":
+			if len(args) != 2 {
+				return nil, c.Errf("format is `header <name> <value>`")
+			}
+			opts.headers[args[0]] = args[1]
+		case "proxy":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `proxy <url>`")
+			}
+			if _, err := neturl.Parse(args[0]); err != nil {
+				return nil, c.Errf("invalid proxy %s", redactURL(args[0]))
+			}
+			opts.proxy = args[0]
+		case "verify-key":
+			if len(args) != 1 {
+				return nil, c.Errf("format is `verify-key <public key | key file>`")
+			}
+			verifier, err := parseVerifyKey(args[0])
+			if err != nil {
+				return nil, c.Errf("invalid verify-key %s", err.Error())
+			}
+			opts.verifier = verifier
+		default:
+			ok, err := opts.guard.parseGuardOption(c, name, args)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, c.Errf("unknown source option '%s'", name)
+			}
+		}
+	}
+	if opts.bearerTokenFile != "" && opts.bearerTokenEnv != "" {
+		return nil, c.Errf("bearer-token-file and bearer-token-env are mutually exclusive")
+	}
+	if opts.bearerTokenFile != "" || opts.bearerTokenEnv != "" {
+		if opts.basicUser != "" {
+			return nil, c.Errf("bearer token and basic-auth are mutually exclusive")
+		}
+	}
+	if _, err := opts.httpClient(); err != nil {
+		return nil, c.Errf("source tls config error %s", err.Error())
+	}
+	return opts, nil
+}
+
+// bearerToken reads the token on every call so that rotated tokens are
+// picked up on the next reload.
+func (o *SourceOptions) bearerToken() (string, error) {
+	switch {
+	case o.bearerTokenFile != "":
+		b, err := ioutil.ReadFile(o.bearerTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case o.bearerTokenEnv != "":
+		v, ok := os.LookupEnv(o.bearerTokenEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", o.bearerTokenEnv)
+		}
+		return strings.TrimSpace(v), nil
+	}
+	return "", nil
+}
+
+// requestHeader builds the headers sent with every download of the source.
+func (o *SourceOptions) requestHeader() (H, error) {
+	header := make(H)
+	if o == nil {
+		return header, nil
+	}
+	for k, v := range o.headers {
+		header[k] = v
+	}
+	token, err := o.bearerToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		header["Authorization"] = "Bearer " + token
+	} else if o.basicUser != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(o.basicUser + ":" + o.basicPass))
+		header["Authorization"] = "Basic " + auth
+	}
+	return header, nil
+}
+
+// String describes the options without revealing any secret.
+func (o *SourceOptions) String() string {
+	if o == nil {
+		return ""
+	}
+	var parts []string
+	if o.tlsCA != "" {
+		parts = append(parts, "tls-ca="+o.tlsCA)
+	}
+	if o.tlsCert != "" {
+		parts = append(parts, "tls-cert="+o.tlsCert)
+	}
+	if len(o.tlsPins) > 0 {
+		parts = append(parts, fmt.Sprintf("tls-pins=%d", len(o.tlsPins)))
+	}
+	if o.insecure {
+		parts = append(parts, "insecure")
+	}
+	if o.bearerTokenFile != "" {
+		parts = append(parts, "bearer-token-file="+o.bearerTokenFile)
+	}
+	if o.bearerTokenEnv != "" {
+		parts = append(parts, "bearer-token-env="+o.bearerTokenEnv)
+	}
+	if o.basicUser != "" {
+		parts = append(parts, "basic-auth="+o.basicUser+":******")
+	}
+	for k := range o.headers {
+		parts = append(parts, "header="+k+":******")
+	}
+	if o.proxy != "" {
+		parts = append(parts, "proxy="+redactURL(o.proxy))
+	}
+	if o.verifier != nil {
+		parts = append(parts, "verify-key")
+	}
+	if o.maxSize > 0 {
+		parts = append(parts, fmt.Sprintf("max-size=%dMB", o.maxSize>>20))
+	}
+	if guard := o.guard.String(); guard != "" {
+		parts = append(parts, guard)
+	}
+	if o.shadow {
+		parts = append(parts, "shadow")
+	}
+	if canary := o.canary.String(); canary != "" {
+		parts = append(parts, canary)
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactURL hides the password of a url so it can be logged.
+func redactURL(s string) string {
+	u, err := neturl.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = neturl.UserPassword(u.User.Username(), "******")
+	}
+	return u.String()
+}
@@ -0,0 +1,118 @@
+package setecs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Severity of a parse diagnostic.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic reports a problem found on one line of a list source.
+type Diagnostic struct {
+	Source   string   `json:"source"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Reason   string   `json:"reason"`
+	Severity Severity `json:"severity"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.Source, d.Line, d.Column, d.Severity, d.Reason)
+}
+
+// listLine is a line of a list with comments and surrounding blanks removed.
+type listLine struct {
+	text   string
+	line   int
+	column int // column of the first character of text, starting at 1
+}
+
+// parseReport collects the diagnostics of one parse of a source.
+type parseReport struct {
+	source      string
+	totalLines  uint64
+	diagnostics []Diagnostic
+}
+
+func newParseReport(source string) *parseReport {
+	return &parseReport{source: source, diagnostics: make([]Diagnostic, 0)}
+}
+
+// scan calls fn for every non empty line of r.
+func (p *parseReport) scan(r io.Reader, fn func(l listLine)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.totalLines++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		column := len(text) - len(trimmed) + 1
+		trimmed = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		if trimmed == "" {
+			continue
+		}
+		fn(listLine{text: trimmed, line: int(p.totalLines), column: column})
+	}
+	if err := scanner.Err(); err != nil {
+		p.add(SeverityError, int(p.totalLines)+1, 1, err.Error())
+	}
+}
+
+func (p *parseReport) add(severity Severity, line, column int, reason string) {
+	d := Diagnostic{
+		Source:   p.source,
+		Line:     line,
+		Column:   column,
+		Reason:   reason,
+		Severity: severity,
+	}
+	p.diagnostics = append(p.diagnostics, d)
+	if severity == SeverityError {
+		log.Error(d.String())
+	} else {
+		log.Warning(d.String())
+	}
+}
+
+// errorf records an error at offset bytes into the text of l.
+func (p *parseReport) errorf(l listLine, offset int, format string, args ...interface{}) {
+	p.add(SeverityError, l.line, l.column+offset, fmt.Sprintf(format, args...))
+}
+
+// warnf records a warning at offset bytes into the text of l.
+func (p *parseReport) warnf(l listLine, offset int, format string, args ...interface{}) {
+	p.add(SeverityWarning, l.line, l.column+offset, fmt.Sprintf(format, args...))
+}
+
+// errors returns the number of lines that failed to parse.
+func (p *parseReport) errors() int {
+	n := 0
+	for _, d := range p.diagnostics {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
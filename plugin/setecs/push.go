@@ -0,0 +1,223 @@
+package setecs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// The inline binding of an ecs address and the inline table can be changed
+// at runtime. Pushed clients join the inline binding of the Corefile for the
+// ecs address, if any, at its position, so an earlier binding still wins for
+// them. Bindings and the table created by a push are placed ahead of all
+// others, so their entries override the lists of the Corefile.
+
+// inlineBinding returns the inline binding of ecsip, creating it when create
+// is set.
+func (se *SetEcs) inlineBinding(ecsip net.IP, create bool) *ecsBinding {
+	se.ecsBindingsLock.Lock()
+	defer se.ecsBindingsLock.Unlock()
+	for _, binding := range se.ecsBindings {
+		if binding.isInline() && binding.ecsip.Equal(ecsip) {
+			return binding
+		}
+	}
+	if !create {
+		return nil
+	}
+	eb := newEcsBinding(ecsip, newInlineSource(), "", nil)
+	eb.loader.changes = se.changes
+	se.ecsBindings = append([]*ecsBinding{eb}, se.ecsBindings...)
+	return eb
+}
+
+// inlineTable returns the table of pushed entries, creating it when create
+// is set.
+func (se *SetEcs) inlineTable(create bool) *ecsTable {
+	se.ecsTablesLock.Lock()
+	defer se.ecsTablesLock.Unlock()
+	for _, table := range se.ecsTables {
+		if table.isInline() {
+			return table
+		}
+	}
+	if !create {
+		return nil
+	}
+	et := newEcsTable(newInlineSource(), "", nil)
+	et.loader.changes = se.changes
+	se.ecsTables = append([]*ecsTable{et}, se.ecsTables...)
+	return et
+}
+
+// pushEntries replaces the entries of an inline source and loads them. When
+// the guard of the source rejects the result the previous entries are
+// restored. The load lock is held throughout, so that no other load sees the
+// rejected entries.
+func (se *SetEcs) pushEntries(loader *sourceLoader, entries []string) error {
+	src := loader.source.(*inlineSource)
+	loader.loadLock.Lock()
+	prev := src.list()
+	src.set(entries)
+	loader.reload()
+	if status := loader.Status(); status.LastError != "" {
+		src.set(prev)
+		loader.reload()
+		loader.loadLock.Unlock()
+		return errors.New(status.LastError)
+	}
+	loader.loadLock.Unlock()
+	se.analyze()
+	return nil
+}
+
+// normalizeClients parses client CIDRs, returning them in canonical form.
+func normalizeClients(clients []string) ([]string, error) {
+	result := make([]string, 0, len(clients))
+	for _, client := range clients {
+		n, err := ParseIpNet(strings.TrimSpace(client))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client %q", client)
+		}
+		result = append(result, n.String())
+	}
+	return result, nil
+}
+
+// AddClients adds client CIDRs to the inline binding of ecsip.
+func (se *SetEcs) AddClients(ecsip net.IP, clients []string) error {
+	se.pushLock.Lock()
+	defer se.pushLock.Unlock()
+	add, err := normalizeClients(clients)
+	if err != nil {
+		return err
+	}
+	eb := se.inlineBinding(ecsip, true)
+	entries := eb.loader.source.(*inlineSource).list()
+	present := make(map[string]bool)
+	if normalized, err := normalizeClients(entries); err == nil {
+		for _, e := range normalized {
+			present[e] = true
+		}
+	}
+	for _, client := range add {
+		if !present[client] {
+			present[client] = true
+			entries = append(entries, client)
+		}
+	}
+	return se.pushEntries(eb.loader, entries)
+}
+
+// RemoveClients removes client CIDRs from the inline binding of ecsip.
+func (se *SetEcs) RemoveClients(ecsip net.IP, clients []string) error {
+	se.pushLock.Lock()
+	defer se.pushLock.Unlock()
+	remove, err := normalizeClients(clients)
+	if err != nil {
+		return err
+	}
+	eb := se.inlineBinding(ecsip, false)
+	if eb == nil {
+		return fmt.Errorf("no inline binding for %s", ecsip)
+	}
+	removed := make(map[string]bool)
+	for _, client := range remove {
+		removed[client] = true
+	}
+	entries := make([]string, 0)
+	for _, entry := range eb.loader.source.(*inlineSource).list() {
+		if n, err := ParseIpNet(entry); err == nil && removed[n.String()] {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return se.pushEntries(eb.loader, entries)
+}
+
+// SetTableEntries adds or replaces entries of the inline table.
+func (se *SetEcs) SetTableEntries(entries map[string]string) error {
+	se.pushLock.Lock()
+	defer se.pushLock.Unlock()
+	for client, ecs := range entries {
+		if !IsIP(client) {
+			return fmt.Errorf("invalid client %q", client)
+		}
+		if net.ParseIP(ecs) == nil {
+			return fmt.Errorf("invalid ecs address %q of client %s", ecs, client)
+		}
+		if strings.Contains(client+ecs, ":") {
+			return fmt.Errorf("ecs tables hold IPv4 entries only, got %s:%s", client, ecs)
+		}
+	}
+	et := se.inlineTable(true)
+	dict := inlineTableDict(et)
+	for client, ecs := range entries {
+		dict[net.ParseIP(client).String()] = net.ParseIP(ecs).String()
+	}
+	return se.pushEntries(et.loader, tableEntries(dict))
+}
+
+// RemoveTableEntries removes clients from the inline table.
+func (se *SetEcs) RemoveTableEntries(clients []string) error {
+	se.pushLock.Lock()
+	defer se.pushLock.Unlock()
+	et := se.inlineTable(false)
+	if et == nil {
+		return fmt.Errorf("no inline table")
+	}
+	dict := inlineTableDict(et)
+	for _, client := range clients {
+		if !IsIP(client) {
+			return fmt.Errorf("invalid client %q", client)
+		}
+		delete(dict, net.ParseIP(client).String())
+	}
+	return se.pushEntries(et.loader, tableEntries(dict))
+}
+
+// InlineBindings returns the entries of the inline bindings by ecs address.
+func (se *SetEcs) InlineBindings() map[string][]string {
+	se.ecsBindingsLock.RLock()
+	defer se.ecsBindingsLock.RUnlock()
+	result := make(map[string][]string)
+	for _, binding := range se.ecsBindings {
+		if binding.isInline() {
+			ecs := binding.ecsip.String()
+			result[ecs] = append(result[ecs], binding.loader.source.(*inlineSource).list()...)
+		}
+	}
+	return result
+}
+
+// InlineTable returns the entries of the inline table.
+func (se *SetEcs) InlineTable() map[string]string {
+	et := se.inlineTable(false)
+	if et == nil {
+		return map[string]string{}
+	}
+	return inlineTableDict(et)
+}
+
+// inlineTableDict returns the client:ecs entries of an inline table as a map.
+func inlineTableDict(et *ecsTable) map[string]string {
+	dict := make(map[string]string)
+	for _, entry := range et.loader.source.(*inlineSource).list() {
+		if sep := strings.IndexByte(entry, ':'); sep > 0 {
+			dict[entry[:sep]] = entry[sep+1:]
+		}
+	}
+	return dict
+}
+
+// tableEntries returns the client:ecs lines of dict in a stable order.
+func tableEntries(dict map[string]string) []string {
+	entries := make([]string, 0, len(dict))
+	for client, ecs := range dict {
+		entries = append(entries, client+":"+ecs)
+	}
+	sort.Strings(entries)
+	return entries
+}
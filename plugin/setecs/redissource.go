@@ -0,0 +1,281 @@
+package setecs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisTimeout      = 5 * time.Second
+	redisPingInterval = 30 * time.Second
+	redisMaxBackoff   = time.Minute
+)
+
+func init() {
+	RegisterSource("redis", newRedisSource)
+	RegisterSource("rediss", newRedisSource)
+}
+
+// redisSource reads a redis key. A hash yields client:ecs lines for
+// ecs-table, a set or a list yields client CIDRs for ecs-binding and a string
+// is taken as the list itself. Updates are picked up through keyspace
+// notifications of the key and through an optional pub/sub channel.
+//
+//	redis://:password@127.0.0.1:6379/0?key=setecs:table&channel=setecs:updates
+type redisSource struct {
+	sync.RWMutex
+	uri        string
+	key        string
+	channel    string
+	db         int
+	client     *redis.Client
+	pubsub     *redis.PubSub
+	subscribed bool
+	dirty      bool
+	pending    int32
+	err        error
+}
+
+func newRedisSource(u *neturl.URL, opts *SourceOptions) (Source, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	query := u.Query()
+	key := query.Get("key")
+	if key == "" {
+		return nil, fmt.Errorf("missing key parameter")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	options := &redis.Options{
+		Addr:         addr,
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+		MaxRetries:   1,
+	}
+	if u.User != nil {
+		options.Username = u.User.Username()
+		options.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+		options.DB = n
+	}
+	if u.Scheme == "rediss" {
+		cfg := &tls.Config{}
+		if opts != nil {
+			var err error
+			if cfg, err = opts.tlsConfig(); err != nil {
+				return nil, err
+			}
+		}
+		cfg.ServerName = u.Hostname()
+		options.TLSConfig = cfg
+	}
+	return &redisSource{
+		uri:     u.String(),
+		key:     key,
+		channel: query.Get("channel"),
+		db:      options.DB,
+		client:  redis.NewClient(options),
+		dirty:   true,
+	}, nil
+}
+
+// Changed reports a change when a notification arrived since the last load.
+// Without a working subscription the key is read on every reload.
+func (rs *redisSource) Changed() bool {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.dirty || !rs.subscribed || rs.err != nil
+}
+
+func (rs *redisSource) Load() ([]byte, error) {
+	rs.Lock()
+	rs.dirty = false
+	rs.Unlock()
+	content, err := rs.read()
+	rs.Lock()
+	defer rs.Unlock()
+	rs.err = err
+	if err != nil {
+		rs.dirty = true
+		return nil, err
+	}
+	return content, nil
+}
+
+func (rs *redisSource) read() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	kind, err := rs.client.Type(ctx, rs.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	switch kind {
+	case "hash":
+		fields, err := rs.client.HGetAll(ctx, rs.key).Result()
+		if err != nil {
+			return nil, err
+		}
+		lines = make([]string, 0, len(fields))
+		for client, ecs := range fields {
+			lines = append(lines, client+":"+ecs)
+		}
+	case "set":
+		lines, err = rs.client.SMembers(ctx, rs.key).Result()
+	case "list":
+		lines, err = rs.client.LRange(ctx, rs.key, 0, -1).Result()
+	case "string":
+		var value string
+		value, err = rs.client.Get(ctx, rs.key).Result()
+		lines = []string{value}
+	case "none":
+		lines = []string{}
+	default:
+		return nil, fmt.Errorf("unsupported type %s of key %s", kind, rs.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a stable order keeps the content hash unchanged when nothing changed
+	if kind != "string" {
+		sort.Strings(lines)
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// channels are the keyspace channel of the key and the configured channel.
+func (rs *redisSource) channels() []string {
+	channels := []string{fmt.Sprintf("__keyspace@%d__:%s", rs.db, rs.key)}
+	if rs.channel != "" {
+		channels = append(channels, rs.channel)
+	}
+	return channels
+}
+
+// Watch subscribes to the channels of the source and reconnects with a
+// backoff when the subscription fails, starting over once a subscription
+// was confirmed. While unsubscribed the source is polled by the reload
+// ticker.
+func (rs *redisSource) Watch(stop <-chan struct{}, notify func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	notify = func(notify func()) func() {
+		return func() {
+			if ctx.Err() == nil {
+				notify()
+			}
+		}
+	}(notify)
+	go func() {
+		<-stop
+		cancel()
+		rs.Lock()
+		if rs.pubsub != nil {
+			rs.pubsub.Close()
+		}
+		rs.Unlock()
+	}()
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		confirmed, err := rs.subscribe(ctx, notify)
+		rs.Lock()
+		rs.subscribed = false
+		rs.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if confirmed {
+			backoff = time.Second
+		}
+		if err != nil {
+			log.Warningf("Subscription of %q failed, retry in %v, err: %v", rs.String(), backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// subscribe follows the channels until the subscription fails, confirmed
+// reports whether redis confirmed the subscription of every channel.
+func (rs *redisSource) subscribe(ctx context.Context, notify func()) (confirmed bool, err error) {
+	pubsub := rs.client.Subscribe(ctx, rs.channels()...)
+	defer pubsub.Close()
+	rs.Lock()
+	rs.pubsub = pubsub
+	rs.Unlock()
+	for _, channel := range rs.channels() {
+		if _, err := pubsub.ReceiveTimeout(ctx, redisTimeout); err != nil {
+			return false, err
+		}
+		log.Debugf("Subscribed to %s for %q", channel, rs.String())
+	}
+	rs.Lock()
+	rs.subscribed = true
+	rs.Unlock()
+	// updates may have been missed while unsubscribed
+	rs.changed(notify)
+
+	for ctx.Err() == nil {
+		msg, err := pubsub.ReceiveTimeout(ctx, redisPingInterval)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if err := pubsub.Ping(ctx); err != nil {
+					return true, err
+				}
+				continue
+			}
+			return true, err
+		}
+		if _, ok := msg.(*redis.Message); ok {
+			rs.changed(notify)
+		}
+	}
+	return true, nil
+}
+
+// changed marks the source dirty and notifies the loader.
+func (rs *redisSource) changed(notify func()) {
+	rs.Lock()
+	rs.dirty = true
+	rs.Unlock()
+	debounceNotify(&rs.pending, notify)
+}
+
+func (rs *redisSource) Health() error {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.err
+}
+
+func (rs *redisSource) Close() error {
+	return rs.client.Close()
+}
+
+func (rs *redisSource) String() string {
+	return redactURL(rs.uri)
+}
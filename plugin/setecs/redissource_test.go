@@ -0,0 +1,80 @@
+package setecs
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisSource(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.HSet("setecs:table", "10.0.0.1", "1.1.1.1")
+	m.SAdd("setecs:clients", "10.1.0.0/16")
+
+	se := NewSetEcs()
+	if err := se.parseEcsTable([]string{"redis://" + m.Addr() + "?key=setecs:table&channel=setecs:updates"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.parseEcsBinding("8.8.8.8", []string{"redis://" + m.Addr() + "/0?key=setecs:clients"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	se.initialLoad()
+	if ip := se.MatchEcsTable("10.0.0.1"); !ip.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("expected table entry, got %v", ip)
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.1.2.3")); !ip.Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expected binding entry, got %v", ip)
+	}
+
+	if err := se.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	source := se.ecsTables[0].loader.source.(*redisSource)
+	waitFor(t, "subscription", func() bool {
+		source.RLock()
+		defer source.RUnlock()
+		return source.subscribed
+	})
+
+	// the reload ticker is disabled, updates arrive through pub/sub
+	m.HSet("setecs:table", "10.0.0.2", "2.2.2.2")
+	m.Publish("setecs:updates", "setecs:table")
+	waitFor(t, "table update", func() bool {
+		return se.MatchEcsTable("10.0.0.2").Equal(net.ParseIP("2.2.2.2"))
+	})
+
+	// the last snapshot stays in use while redis is unavailable
+	m.Close()
+	waitFor(t, "subscription loss", func() bool { return source.Changed() })
+	se.updateList()
+	if ip := se.MatchEcsTable("10.0.0.2"); !ip.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("expected last snapshot, got %v", ip)
+	}
+	if source.Health() == nil {
+		t.Fatal("expected health error while redis is down")
+	}
+	if status := se.ecsTables[0].loader.Status(); status.LastError == "" || status.Entries != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if err := se.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,12 +1,23 @@
 package setecs
 
 import (
+	"net"
+	"strconv"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
 type ResponseReverter struct {
 	dns.ResponseWriter
-	removeEcs bool
+	removeEcs  bool
+	sentEcs    *dns.EDNS0_SUBNET // the option set by the plugin, nil when none
+	source     string            // the table or binding that matched
+	audit      *auditLog
+	entry      *auditEntry // pending audit entry, written with the response
+	experiment string      // the experiment and arm of the query, empty outside of experiments
+	arm        string
+	start      time.Time // when the query was passed on
 }
 
 func NewResponseReverter(w dns.ResponseWriter) *ResponseReverter {
@@ -26,8 +37,67 @@ func (r *ResponseReverter) Write(buf []byte) (int, error) {
 func (r *ResponseReverter) WriteMsg(res1 *dns.Msg) error {
 	// Deep copy 'res' as to not (e.g). rewrite a message that's also stored in the cache.
 	res := res1.Copy()
+	if r.sentEcs != nil {
+		r.recordEcs(getMsgECS(res))
+	}
+	if r.arm != "" {
+		r.recordArm(res)
+	}
+	r.writeAudit()
 	if r.removeEcs {
 		removeECS(res)
 	}
 	return r.ResponseWriter.WriteMsg(res)
 }
+
+// recordEcs counts the ECS option echoed by upstream for the option sent,
+// with the scope prefix length of valid echoes.
+func (r *ResponseReverter) recordEcs(got *dns.EDNS0_SUBNET) {
+	ecs := r.sentEcs.Address.String()
+	echo := ecsEcho(r.sentEcs, got)
+	upstreamEcs.WithLabelValues(r.source, ecs, echo).Inc()
+	if echo == echoValid {
+		upstreamScope.WithLabelValues(r.source, ecs, strconv.Itoa(int(got.SourceScope))).Inc()
+		if r.entry != nil {
+			scope := got.SourceScope
+			r.entry.Scope = &scope
+		}
+	}
+}
+
+// recordArm records the upstream round trip and answer of a query in an
+// experiment arm.
+func (r *ResponseReverter) recordArm(res *dns.Msg) {
+	experimentRtt.WithLabelValues(r.experiment, r.arm).Observe(time.Since(r.start).Seconds())
+	experimentAnswers.WithLabelValues(r.experiment, r.arm).Observe(float64(len(res.Answer)))
+	experimentResponses.WithLabelValues(r.experiment, r.arm, dns.RcodeToString[res.Rcode]).Inc()
+}
+
+// writeAudit queues the pending audit entry, once.
+func (r *ResponseReverter) writeAudit() {
+	if r.entry != nil {
+		r.audit.write(*r.entry)
+		r.entry = nil
+	}
+}
+
+// ecsEcho classifies the ECS option of a response. RFC 7871 section 7.3
+// requires the family, source prefix length and address of the query, and
+// a scope prefix length within the address.
+func ecsEcho(sent, got *dns.EDNS0_SUBNET) string {
+	if got == nil {
+		return echoMissing
+	}
+	bits := 32
+	if sent.Family == 2 {
+		bits = 128
+	}
+	if got.Family != sent.Family || got.SourceNetmask != sent.SourceNetmask || int(got.SourceScope) > bits {
+		return echoInvalid
+	}
+	mask := net.CIDRMask(int(sent.SourceNetmask), bits)
+	if got.Address == nil || !got.Address.Mask(mask).Equal(sent.Address.Mask(mask)) {
+		return echoInvalid
+	}
+	return echoValid
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -18,39 +19,105 @@ type SetEcs struct {
 	Next            plugin.Handler
 	debug           bool
 	reload          time.Duration
+	cacheDir        string
+	changes         *changeNotifier
+	conflictsLock   sync.RWMutex
+	conflicts       []Conflict
+	pushLock        sync.Mutex
+	admin           *adminServer
+	debugResponder  *debugResponder
+	chaosStatus     *chaosStatus
+	audit           *auditLog
+	shadow          bool // every source in shadow mode, nothing is applied
+	experiment      *experiment
+	hasShadow       bool   // a shadow decision is computed next to the active one
+	defaultEcs      net.IP // ecs address of the clients without a match
+	stripClientEcs  bool   // remove the ECS option of the clients without a match
+	generation      uint64 // incremented by every reload that changes a source
 	stopReload      chan struct{}
 	ecsBindings     []*ecsBinding
 	ecsTables       []*ecsTable
 }
 
 func NewSetEcs() *SetEcs {
-	return &SetEcs{
+	se := &SetEcs{
 		ecsTablesLock:   sync.RWMutex{},
 		ecsBindingsLock: sync.RWMutex{},
 		stopReload:      make(chan struct{}),
+		changes:         newChangeNotifier(),
 		ecsBindings:     make([]*ecsBinding, 0),
 		ecsTables:       make([]*ecsTable, 0),
 	}
+	se.changes.subscribe(func(ReloadDiff) {
+		atomic.AddUint64(&se.generation, 1)
+	})
+	return se
+}
+
+// Generation returns the version of the snapshot in use, it is incremented
+// by every reload that changes a source.
+func (se *SetEcs) Generation() uint64 {
+	return atomic.LoadUint64(&se.generation)
 }
 
 func (se *SetEcs) MatchEcsTable(ipstr string) net.IP {
+	ecsip, _ := se.matchTable(ipstr, false)
+	return ecsip
+}
+
+func (se *SetEcs) MatchEcsBinding(ip net.IP) net.IP {
+	if bind := se.matchBinding(ip, false); bind != nil {
+		return bind.ecsip
+	}
+	return nil
+}
+
+// inShadow reports whether a source only takes part in shadow decisions.
+func (se *SetEcs) inShadow(l *sourceLoader) bool {
+	return se.shadow || l.isShadow()
+}
+
+// matchTable returns the ecs address of a client and the first table
+// listing it, including the shadow tables when withShadow is set. Single
+// addresses of all tables are matched before the CIDR clients.
+func (se *SetEcs) matchTable(ipstr string, withShadow bool) (net.IP, *ecsTable) {
 	se.ecsTablesLock.RLock()
 	defer se.ecsTablesLock.RUnlock()
 	for _, table := range se.ecsTables {
-		ecsip, ok := table.dict[ipstr]
+		if !withShadow && se.inShadow(table.loader) {
+			continue
+		}
+		ecsip, ok := table.lookup(ipstr)
 		if ok {
-			return ecsip
+			return ecsip, table
 		}
 	}
-	return nil
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return nil, nil
+	}
+	for _, table := range se.ecsTables {
+		if !withShadow && se.inShadow(table.loader) {
+			continue
+		}
+		if _, ecsip, ok := table.lookupNet(ip); ok {
+			return ecsip, table
+		}
+	}
+	return nil, nil
 }
 
-func (se *SetEcs) MatchEcsBinding(ip net.IP) net.IP {
+// matchBinding returns the first binding containing a client, including the
+// shadow bindings when withShadow is set.
+func (se *SetEcs) matchBinding(ip net.IP, withShadow bool) *ecsBinding {
 	se.ecsBindingsLock.RLock()
 	defer se.ecsBindingsLock.RUnlock()
 	for _, bind := range se.ecsBindings {
+		if !withShadow && se.inShadow(bind.loader) {
+			continue
+		}
 		if bind.existIp(ip) {
-			return bind.ecsip
+			return bind
 		}
 	}
 	return nil
@@ -65,6 +132,9 @@ func (se *SetEcs) addEcsTable(t *ecsTable) {
 func (se *SetEcs) addEcsBinding(b *ecsBinding) {
 	se.ecsBindingsLock.Lock()
 	defer se.ecsBindingsLock.Unlock()
+	b.promote = func(generation uint64) {
+		se.promoteCanaries([]*ecsBinding{b}, generation)
+	}
 	se.ecsBindings = append(se.ecsBindings, b)
 }
 
@@ -75,42 +145,113 @@ func (se *SetEcs) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 	if clientIp == nil {
 		return plugin.NextOrFailure(state.Name(), se.Next, ctx, w, r)
 	}
-
-	var qHasECS = getMsgECS(r) != nil
-	var wr = NewResponseReverter(w)
-	var ecs *dns.EDNS0_SUBNET
-
-	var ecsip = se.MatchEcsTable(state.IP())
-	if ecsip != nil {
-		ecsip = se.MatchEcsBinding(clientIp)
+	if se.debugResponder.match(state) {
+		return se.debugResponder.serve(se, state, clientIp), nil
+	}
+	if se.chaosStatus.match(state) {
+		return se.chaosStatus.serve(se, state, clientIp), nil
+	}
+	if r.Opcode == dns.OpcodeNotify && se.handleNotify(state.Name(), clientIp) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
 	}
 
-	if ecsip != nil {
-		if ip4 := ecsip.To4(); ip4 != nil { // is ipv4
-			ecs = newEDNS0Subnet(ip4, 24, false)
-		} else {
-			if ip6 := ecsip.To16(); ip6 != nil { // is ipv6
-				ecs = newEDNS0Subnet(ip6, 48, true)
-			}
+	var d = se.decision(ctx, state, clientIp)
+	var qHasECS = d.clientEcs != nil
+	var wr = NewResponseReverter(w)
+	countDecision(queries, d)
+	if d.shadow != nil {
+		result := "disagree"
+		if d.agrees() {
+			result = "agree"
 		}
+		shadowAgreement.WithLabelValues(result).Inc()
+		countDecision(shadowQueries, d.shadow)
+	}
+	if d.arm != "" {
+		experimentQueries.WithLabelValues(se.experiment.name, d.arm).Inc()
+		wr.experiment, wr.arm, wr.start = se.experiment.name, d.arm, time.Now()
 	}
 
 	// 强制设置 ECS， 如果请求本身没有 ECS， 那么响应中必须清除 ECS
-	if ecs != nil {
-		setECS(r, ecs)
+	if d.ecs != nil {
+		setECS(r, d.ecs)
 		wr.removeEcs = qHasECS
+		wr.sentEcs, wr.source = d.ecs, d.source
+	} else if d.action == decisionStrip {
+		removeECS(r)
+	}
+	if se.audit.sampled() {
+		wr.audit, wr.entry = se.audit, &auditEntry{
+			Time:      time.Now().UTC(),
+			Client:    clientIp.String(),
+			Name:      state.Name(),
+			Type:      state.Type(),
+			ClientEcs: ecsSubnet(d.clientEcs),
+			Ecs:       ecsSubnet(d.ecs),
+			Action:    d.action,
+			Source:    d.source,
+			Arm:       d.arm,
+		}
+		if d.shadow != nil {
+			wr.entry.Shadow = &auditShadow{
+				Ecs:    ecsSubnet(d.shadow.ecs),
+				Action: d.shadow.action,
+				Source: d.shadow.source,
+				Agree:  d.agrees(),
+			}
+		}
 	}
 
-	return plugin.NextOrFailure(state.Name(), se.Next, ctx, wr, r)
+	rcode, err := plugin.NextOrFailure(state.Name(), se.Next, ctx, wr, r)
+	wr.writeAudit() // no response was written
+	return rcode, err
 }
 
 func (se *SetEcs) Name() string { return "setecs" }
 
-func (se *SetEcs) InlineEcsBinding() *ecsBinding {
-	se.ecsBindingsLock.Lock()
-	defer se.ecsBindingsLock.Unlock()
+// ecsOption returns the ECS option announcing ecsip, /24 for IPv4 and /48 for
+// IPv6, or nil.
+func ecsOption(ecsip net.IP) *dns.EDNS0_SUBNET {
+	if ecsip == nil {
+		return nil
+	}
+	if ip4 := ecsip.To4(); ip4 != nil { // is ipv4
+		return newEDNS0Subnet(ip4, 24, false)
+	}
+	if ip6 := ecsip.To16(); ip6 != nil { // is ipv6
+		return newEDNS0Subnet(ip6, 48, true)
+	}
+	return nil
+}
+
+// handleNotify passes a NOTIFY to the sources of the zone and reports
+// whether one of them accepted it. Other NOTIFY messages go to the next
+// plugin.
+func (se *SetEcs) handleNotify(zone string, from net.IP) bool {
+	handled := false
+	for _, loader := range se.loaders() {
+		if h, ok := loader.source.(notifyHandler); ok && h.handleNotify(zone, from) {
+			handled = true
+		}
+	}
+	return handled
+}
+
+func (se *SetEcs) InlineEcsBinding(ecsip net.IP) *ecsBinding {
+	return se.inlineBinding(ecsip, false)
+}
+
+// shadowInlineBinding returns the binding of the inline CIDRs of ecsip listed
+// in shadow mode.
+func (se *SetEcs) shadowInlineBinding(ecsip net.IP) *ecsBinding {
+	se.ecsBindingsLock.RLock()
+	defer se.ecsBindingsLock.RUnlock()
 	for _, binding := range se.ecsBindings {
-		if binding.whichType == ItemTypeInline {
+		if _, ok := binding.loader.source.(*inlineSource); ok && binding.loader.isShadow() && binding.ecsip.Equal(ecsip) {
 			return binding
 		}
 	}
@@ -118,58 +259,84 @@ func (se *SetEcs) InlineEcsBinding() *ecsBinding {
 }
 
 // 解析 ecsBindinbg
-func (se *SetEcs) parseEcsBinding(ecsip string, items []string) error {
+func (se *SetEcs) parseEcsBinding(ecsip string, items []string, opts *SourceOptions) error {
 	ecsipb := net.ParseIP(ecsip)
 	if ecsipb == nil {
 		return fmt.Errorf("error ecsip %s", ecsip)
 	}
 	for _, item := range items {
-		switch {
-		case FileExists(item):
-			eb := newEcsBinding(ItemTypePath, ecsipb, item, "")
-			eb.loadFromFile()
-			se.addEcsBinding(eb)
-		case IsURL(item):
-			eb := newEcsBinding(ItemTypeUrl, ecsipb, "", item)
-			eb.loadFromUrl()
+		src, err := newSource(item, opts)
+		if err != nil {
+			return err
+		}
+		if src != nil {
+			se.addEcsBinding(newEcsBinding(ecsipb, src, item, opts))
+			continue
+		}
+		if _, err := parseIpNet(item); err != nil {
+			log.Error(err)
+			continue
+		}
+		var eb *ecsBinding
+		if opts != nil && opts.shadow {
+			eb = se.shadowInlineBinding(ecsipb)
+		} else {
+			eb = se.InlineEcsBinding(ecsipb)
+		}
+		if eb == nil {
+			eb = newEcsBinding(ecsipb, newInlineSource(), "", opts)
 			se.addEcsBinding(eb)
-		default:
-			ipn, err := parseIpNet(item)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			eb := se.InlineEcsBinding()
-			if eb == nil {
-				eb = newEcsBinding(ItemTypeInline, ecsipb, "", "")
-				se.addEcsBinding(eb)
-			}
-			eb.addInline(ipn)
 		}
+		eb.addInline(item)
 	}
 
 	return nil
 }
 
 // 解析 ECS TABLE
-func (se *SetEcs) parseEcsTable(items []string) error {
+func (se *SetEcs) parseEcsTable(items []string, opts *SourceOptions) error {
 	for _, item := range items {
-		switch {
-		case FileExists(item):
-			eb := newEcsTable(ItemTypePath, item, "")
-			eb.loadFromFile()
-			se.addEcsTable(eb)
-		case IsURL(item):
-			eb := newEcsTable(ItemTypePath, "", item)
-			eb.loadFromFile()
-			se.addEcsTable(eb)
-		default:
+		src, err := newSource(item, opts)
+		if err != nil {
+			return err
+		}
+		if src == nil {
 			log.Errorf("ecs-table format error %s", item)
+			continue
 		}
+		se.addEcsTable(newEcsTable(src, item, opts))
 	}
 	return nil
 }
 
+// initialLoad populates all sources once the whole block has been parsed.
+// Remote sources start from their cached copy so that they are usable even
+// when the first fetch fails.
+func (se *SetEcs) initialLoad() {
+	for _, loader := range se.loaders() {
+		loader.cacheDir = se.cacheDir
+		loader.changes = se.changes
+		loader.loadFromCache()
+	}
+	se.updateList()
+}
+
+// loaders returns the loaders of all tables and bindings, tables first.
+func (se *SetEcs) loaders() []*sourceLoader {
+	se.ecsTablesLock.RLock()
+	se.ecsBindingsLock.RLock()
+	defer se.ecsTablesLock.RUnlock()
+	defer se.ecsBindingsLock.RUnlock()
+	loaders := make([]*sourceLoader, 0, len(se.ecsTables)+len(se.ecsBindings))
+	for _, item := range se.ecsTables {
+		loaders = append(loaders, item.loader)
+	}
+	for _, item := range se.ecsBindings {
+		loaders = append(loaders, item.loader)
+	}
+	return loaders
+}
+
 func (se *SetEcs) periodicUpdate() {
 	// Kick off initial name list content population
 	if se.reload > 0 {
@@ -188,38 +355,61 @@ func (se *SetEcs) periodicUpdate() {
 }
 
 func (se *SetEcs) updateList() {
-
-	for _, item := range se.ecsTables {
-		switch item.whichType {
-		case ItemTypePath:
-			item.loadFromFile()
-		case ItemTypeUrl:
-			item.loadFromUrl()
-		default:
-		}
+	for _, loader := range se.loaders() {
+		loader.load()
 	}
 
-	for _, item := range se.ecsBindings {
-		switch item.whichType {
-		case ItemTypePath:
-			item.loadFromFile()
-		case ItemTypeUrl:
-			item.loadFromUrl()
-		default:
-		}
-	}
+	se.analyze()
 }
 
 func (se *SetEcs) OnStartup() error {
 	se.periodicUpdate()
+	for _, loader := range se.loaders() {
+		loader := loader
+		loader.watch(se.stopReload, func() {
+			loader.load()
+			se.analyze()
+		})
+	}
 	return nil
 }
 
+// OnShutdown stops the reloads and the canary windows, also on a restart,
+// and closes the sources.
 func (se *SetEcs) OnShutdown() error {
 	close(se.stopReload)
+	se.ecsBindingsLock.RLock()
+	for _, binding := range se.ecsBindings {
+		binding.stopCanary()
+	}
+	se.ecsBindingsLock.RUnlock()
+	for _, loader := range se.loaders() {
+		loader.close()
+	}
 	return nil
 }
 
+// Diagnostics returns the problems found by the last parse of every source,
+// keyed by source name.
+func (se *SetEcs) Diagnostics() map[string][]Diagnostic {
+	result := make(map[string][]Diagnostic)
+	se.ecsTablesLock.RLock()
+	for _, t := range se.ecsTables {
+		if diags := t.Diagnostics(); len(diags) > 0 {
+			result[t.sourceName()] = append(result[t.sourceName()], diags...)
+		}
+	}
+	se.ecsTablesLock.RUnlock()
+	se.ecsBindingsLock.RLock()
+	for _, b := range se.ecsBindings {
+		if diags := b.Diagnostics(); len(diags) > 0 {
+			result[b.sourceName()] = append(result[b.sourceName()], diags...)
+		}
+	}
+	se.ecsBindingsLock.RUnlock()
+	return result
+}
+
 func (se *SetEcs) debugPrint() {
 	for _, s := range se.ecsBindings {
 		log.Infof(s.String())
@@ -227,5 +417,46 @@ func (se *SetEcs) debugPrint() {
 	for _, s := range se.ecsTables {
 		log.Infof(s.String())
 	}
+	for _, diags := range se.Diagnostics() {
+		for _, d := range diags {
+			log.Info(d.String())
+		}
+	}
+	for _, loader := range se.loaders() {
+		if status := loader.Status(); status.Revision > 0 {
+			log.Infof("%s at revision %d", status.Source, status.Revision)
+		}
+	}
 	log.Info("reload ", se.reload)
+	if se.cacheDir != "" {
+		log.Info("cache-dir ", se.cacheDir)
+	}
+	if se.admin != nil {
+		log.Info("admin ", se.admin.addr)
+	}
+	if se.debugResponder != nil {
+		log.Infof("debug-responder %s %v", se.debugResponder.name, se.debugResponder.allow)
+	}
+	if se.chaosStatus != nil {
+		log.Infof("chaos-status %s %v", se.chaosStatus.name, se.chaosStatus.allow)
+	}
+	if se.defaultEcs != nil {
+		log.Info("default-ecs ", se.defaultEcs)
+	}
+	if se.stripClientEcs {
+		log.Info("strip-client-ecs")
+	}
+	if se.shadow {
+		log.Infof("shadow mode, decisions are not applied")
+	}
+	if ex := se.experiment; ex != nil {
+		for _, arm := range ex.arms {
+			log.Infof("experiment %s arm %s weight %d/%d prefix %d/%d ecs %v",
+				ex.name, arm.name, arm.weight, ex.total, arm.prefix4, arm.prefix6, arm.ecs)
+		}
+	}
+	if se.audit != nil {
+		log.Infof("audit %s sample %v max-size %d max-backups %d buffer %d",
+			se.audit.path, se.audit.sample, se.audit.maxSize, se.audit.maxBackups, se.audit.bufferSize)
+	}
 }
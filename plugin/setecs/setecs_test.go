@@ -1,7 +1,17 @@
 package setecs
 
 import (
+	"errors"
+	"io/ioutil"
+	"net"
+	neturl "net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/c-robinson/iplib"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 func Test_parseIpNet(t *testing.T) {
@@ -13,3 +23,355 @@ func Test_parseIpNet(t *testing.T) {
 	t.Log(ip.FirstAddress())
 	t.Log(ip.LastAddress())
 }
+
+func TestReloadGuard(t *testing.T) {
+	g := newReloadGuard()
+	g.maxShrink = 0.5
+	g.maxErrors = 2
+	g.rejectEmpty = true
+	tests := []struct {
+		prev, next, errs int
+		reason           string
+	}{
+		{100, 90, 0, ""},
+		{100, 40, 0, "shrink"},
+		{0, 10, 0, ""},
+		{10, 0, 0, "empty"},
+		{10, 10, 3, "parse_errors"},
+	}
+	for _, tt := range tests {
+		if got := g.check(tt.prev, tt.next, tt.errs); got != tt.reason {
+			t.Errorf("check(%d, %d, %d) = %q, want %q", tt.prev, tt.next, tt.errs, got, tt.reason)
+		}
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	se := NewSetEcs()
+	var got []ReloadDiff
+	se.OnChange(func(diff ReloadDiff) {
+		got = append(got, diff)
+	})
+
+	eb := newEcsBinding(net.ParseIP("8.8.8.8"), newFileSource("clients.txt", nil), "clients.txt", nil)
+	eb.loader.changes = se.changes
+	a, _ := parseIpNet("10.0.0.0/24")
+	b, _ := parseIpNet("10.0.1.0/24")
+	c, _ := parseIpNet("10.0.2.0/24")
+	eb.replaceClients([]iplib.Net{a, b})
+	eb.replaceClients([]iplib.Net{a, b})
+	eb.replaceClients([]iplib.Net{b, c})
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 change events, got %d", len(got))
+	}
+	diff := got[1]
+	if diff.Ecs != "8.8.8.8" || len(diff.Added) != 1 || diff.Added[0] != "10.0.2.0/24" ||
+		len(diff.Removed) != 1 || diff.Removed[0] != "10.0.0.0/24" {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	et := newEcsTable(newFileSource("tables.txt", nil), "tables.txt", nil)
+	dict, report := et.parse(strings.NewReader("# comment\n127.0.0.1:1.1.1.1\n\n  10.0.0.1:bad\nnosep\n"))
+	if len(dict) != 1 || report.totalLines != 5 {
+		t.Fatalf("unexpected result %v %d", dict, report.totalLines)
+	}
+	if report.errors() != 2 {
+		t.Fatalf("expected 2 errors, got %v", report.diagnostics)
+	}
+	d := report.diagnostics[0]
+	if d.Source != "tables.txt" || d.Line != 4 || d.Column != 12 || d.Severity != SeverityError {
+		t.Fatalf("unexpected diagnostic %s", d)
+	}
+}
+
+func TestAnalyzeConflicts(t *testing.T) {
+	a := newEcsBinding(net.ParseIP("8.8.8.8"), newFileSource("a.txt", nil), "a.txt", nil)
+	a.clients, a.origins, _ = a.parseOrigins(strings.NewReader("10.0.0.0/16\n10.0.1.0/24\n"))
+	b := newEcsBinding(net.ParseIP("9.9.9.9"), newFileSource("b.txt", nil), "b.txt", nil)
+	b.clients, b.origins, _ = b.parseOrigins(strings.NewReader("10.0.2.0/24\n192.168.0.0/24\n"))
+	tb := newEcsTable(newFileSource("t.txt", nil), "t.txt", nil)
+	tb.dict, _ = tb.parse(strings.NewReader("192.168.0.1:1.1.1.1\n"))
+
+	conflicts := analyzeConflicts([]*ecsBinding{a, b}, []*ecsTable{tb})
+	kinds := make(map[ConflictKind]Conflict)
+	for _, c := range conflicts {
+		kinds[c.Kind] = c
+	}
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts, got %v", conflicts)
+	}
+	if c := kinds[ConflictOverlap]; c.Entry != "10.0.1.0/24" || c.Other != "10.0.0.0/16" {
+		t.Errorf("unexpected overlap %s", c)
+	}
+	if c := kinds[ConflictShadowed]; c.Entry != "10.0.2.0/24" || c.Winner != "a.txt" {
+		t.Errorf("unexpected shadowed %s", c)
+	}
+	if c := kinds[ConflictTableBinding]; c.Other != "192.168.0.0/24" || c.Winner != "t.txt" {
+		t.Errorf("unexpected table-binding %s", c)
+	}
+}
+
+func TestAggregateNets(t *testing.T) {
+	var nets []iplib.Net
+	for _, s := range []string{
+		"10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24", "10.0.1.7", "10.0.1.0/24",
+		"192.168.1.5/24", "2001:db8::/33", "2001:db8:8000::/33", "2001:db8::1",
+	} {
+		n, err := parseIpNet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	var got []string
+	for _, n := range aggregateNets(nets) {
+		got = append(got, n.String())
+	}
+	want := []string{"10.0.0.0/23", "192.168.1.0/24", "2001:db8::/32"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("aggregateNets = %v, want %v", got, want)
+	}
+}
+
+func TestAggregateNetsFamilies(t *testing.T) {
+	eb := newEcsBinding(net.ParseIP("8.8.8.8"), newFileSource("mixed.txt", nil), "mixed.txt", nil)
+	eb.clients, eb.origins, _ = eb.parseOrigins(strings.NewReader("::/0\n10.0.0.0/8\n2001:db8::/32\n"))
+	var got []string
+	for _, n := range eb.clients {
+		got = append(got, n.String())
+	}
+	if want := []string{"10.0.0.0/8", "::/0"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("aggregated %v, want %v", got, want)
+	}
+	if !eb.existIp(net.ParseIP("10.1.1.1")) || eb.existIp(net.ParseIP("11.1.1.1")) || !eb.existIp(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected matches of %v", got)
+	}
+	// the IPv6 prefixes overlap each other, not the IPv4 one
+	conflicts := analyzeConflicts([]*ecsBinding{eb}, nil)
+	if len(conflicts) != 1 || conflicts[0].Entry != "2001:db8::/32" || conflicts[0].Other != "::/0" {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+}
+
+type staticSource struct {
+	content string
+	err     error
+}
+
+func (s *staticSource) Changed() bool         { return true }
+func (s *staticSource) Load() ([]byte, error) { return []byte(s.content), s.err }
+func (s *staticSource) Health() error         { return s.err }
+func (s *staticSource) String() string        { return "static" }
+
+func TestRegisterSource(t *testing.T) {
+	RegisterSource("static", func(u *neturl.URL, opts *SourceOptions) (Source, error) {
+		return &staticSource{content: strings.ReplaceAll(u.Opaque, ",", "\n")}, nil
+	})
+	t.Cleanup(func() {
+		sourceFactoriesLock.Lock()
+		delete(sourceFactories, "static")
+		sourceFactoriesLock.Unlock()
+	})
+	se := NewSetEcs()
+	if err := se.parseEcsBinding("8.8.8.8", []string{"static:10.1.0.0/16,10.2.0.0/16"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	se.initialLoad()
+	if ip := se.MatchEcsBinding(net.ParseIP("10.2.3.4")); !ip.Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expected match from static source, got %v", ip)
+	}
+}
+
+func TestRejectedReload(t *testing.T) {
+	src := &staticSource{content: "10.1.0.0/16\n"}
+	opts := newSourceOptions()
+	opts.guard.rejectEmpty = true
+	eb := newEcsBinding(net.ParseIP("8.8.8.8"), src, "static:", opts)
+	eb.loader.load()
+
+	src.content = ""
+	eb.loader.load()
+	if got := eb.loader.Status().LastError; got != errReloadRejected.Error() {
+		t.Fatalf("unexpected status %q", got)
+	}
+	src.err = errors.New("unreachable")
+	eb.loader.load()
+	// the same content again is still reported as rejected
+	src.err = nil
+	eb.loader.load()
+	if got := eb.loader.Status().LastError; got != errReloadRejected.Error() {
+		t.Fatalf("unexpected status %q", got)
+	}
+	if !eb.existIp(net.ParseIP("10.1.0.1")) {
+		t.Fatal("expected the previous clients to stay in use")
+	}
+}
+
+func TestEcsEcho(t *testing.T) {
+	sent := newEDNS0Subnet(net.ParseIP("1.2.3.4").To4(), 24, false)
+	echo := func(family uint16, netmask, scope uint8, addr string) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: netmask, SourceScope: scope, Address: net.ParseIP(addr)}
+	}
+	for _, c := range []struct {
+		got  *dns.EDNS0_SUBNET
+		want string
+	}{
+		{nil, echoMissing},
+		{echo(1, 24, 16, "1.2.3.0"), echoValid},
+		{echo(1, 24, 0, "1.2.3.0"), echoValid},
+		{echo(2, 24, 24, "::1"), echoInvalid},
+		{echo(1, 16, 16, "1.2.0.0"), echoInvalid},
+		{echo(1, 24, 24, "1.2.4.0"), echoInvalid},
+		{echo(1, 24, 33, "1.2.3.0"), echoInvalid},
+	} {
+		if got := ecsEcho(sent, c.got); got != c.want {
+			t.Errorf("ecsEcho(%v) = %s, want %s", c.got, got, c.want)
+		}
+	}
+}
+
+func TestCanary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.txt")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	se, err := parseSetEcs(caddy.NewTestController("dns", `setecs {
+        ecs-binding 1.1.1.1 clients `+path+` {
+            canary 50
+        }
+    }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("10.0.0.0/8\n192.168.0.0/16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	eb := se.ecsBindings[0]
+	eb.loader.load()
+
+	var in, out net.IP
+	for i := 1; in == nil || out == nil; i++ {
+		ip := net.IPv4(192, 168, byte(i>>8), byte(i))
+		if canaryBucket(ip) < 50 {
+			in = ip
+		} else {
+			out = ip
+		}
+	}
+	if !eb.existIp(in) || eb.existIp(out) {
+		t.Fatalf("expected the new version for %s only, not for %s", in, out)
+	}
+	if canaries := se.Canaries(); len(canaries) != 1 || canaries[0].Entries != 2 || canaries[0].StableEntries != 1 {
+		t.Fatalf("unexpected canaries %+v", canaries)
+	}
+	if n, err := se.PromoteCanary(path); err != nil || n != 1 {
+		t.Fatalf("promote: %d %v", n, err)
+	}
+	if !eb.existIp(out) {
+		t.Fatalf("expected the new version for %s after promotion", out)
+	}
+	if _, err := se.PromoteCanary(""); err == nil {
+		t.Fatal("expected no canary in progress")
+	}
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "tables.txt")
+	if err := ioutil.WriteFile(table, []byte("10.240.0.1:3.3.3.3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	se, err := parseSetEcs(caddy.NewTestController("dns", `setecs {
+        ecs-binding 1.1.1.1 clients 10.240.0.0/16
+        ecs-binding 2.2.2.2 clients 10.241.0.0/16
+        ecs-binding 1.1.1.1 clients 10.242.0.0/16
+        ecs-table `+table+`
+    }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		client string
+		want   string
+	}{
+		{"10.240.0.1", "3.3.3.3"}, // table entries win over bindings
+		{"10.240.0.2", "1.1.1.1"}, // bindings apply without a table entry
+		{"10.241.0.1", "2.2.2.2"}, // inline clients are kept per ecs address
+		{"10.242.0.1", "1.1.1.1"},
+		{"10.243.0.1", "<nil>"},
+	} {
+		d := se.lookup(c.client, net.ParseIP(c.client), nil, false)
+		if d.ecsip.String() != c.want {
+			t.Errorf("lookup(%s) = %v, want %s", c.client, d.ecsip, c.want)
+		}
+	}
+	if eb := se.InlineEcsBinding(net.ParseIP("2.2.2.2")); eb == nil || !eb.existIp(net.ParseIP("10.241.0.1")) || eb.existIp(net.ParseIP("10.240.0.1")) {
+		t.Fatalf("unexpected inline binding of 2.2.2.2 %v", eb)
+	}
+}
+
+func TestExcludeNets(t *testing.T) {
+	var nets, exclude []iplib.Net
+	for _, s := range []string{"10.0.0.0/22", "2001:db8::/32", "192.168.0.0/24"} {
+		n, _ := parseIpNet(s)
+		nets = append(nets, n)
+	}
+	for _, s := range []string{"10.0.1.0/24", "2001:db8::/32", "192.168.0.0/16", "::/0"} {
+		n, _ := parseIpNet(s)
+		exclude = append(exclude, n)
+	}
+	var got []string
+	for _, n := range excludeNets(nets, exclude) {
+		got = append(got, n.String())
+	}
+	if want := []string{"10.0.0.0/24", "10.0.2.0/23"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("excludeNets = %v, want %v", got, want)
+	}
+}
+
+func TestCanaryWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.txt")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	se, err := parseSetEcs(caddy.NewTestController("dns", `setecs {
+        ecs-binding 1.1.1.1 clients `+path+` {
+            canary 50 100ms
+        }
+        ecs-binding 2.2.2.2 clients 192.168.1.0/24
+    }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.OnShutdown()
+	if err := ioutil.WriteFile(path, []byte("10.0.0.0/8\n192.168.0.0/16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	generation := se.Generation()
+	se.updateList()
+	if se.Generation() == generation {
+		t.Fatal("expected staging a canary to bump the generation")
+	}
+	if sources := se.Sources(); sources[0].Snapshot != snapshotCanary || sources[0].Entries != 2 || sources[0].StableEntries != 1 {
+		t.Fatalf("unexpected source status %+v", sources[0])
+	}
+	if dump := se.Dump(); len(dump.Bindings) != 3 || dump.Bindings[1].Snapshot != snapshotCanary || dump.Bindings[1].Percent != 50 {
+		t.Fatalf("unexpected dump %+v", dump.Bindings)
+	}
+	if conflicts := se.Conflicts(); len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts of the stable version %v", conflicts)
+	}
+
+	// the promotion by the window analyzes the conflicts of the new version
+	waitFor(t, "promotion", func() bool {
+		return len(se.Conflicts()) > 0
+	})
+	if conflicts := se.Conflicts(); len(conflicts) != 1 || conflicts[0].Kind != ConflictShadowed {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+	if sources := se.Sources(); len(se.Canaries()) != 0 || sources[0].Snapshot != snapshotStable || sources[0].StableEntries != 0 {
+		t.Fatalf("unexpected source status %+v", sources[0])
+	}
+}
@@ -1,6 +1,8 @@
 package setecs
 
 import (
+	"net"
+	"os"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -40,6 +42,19 @@ func setup(c *caddy.Controller) error {
 		return p.OnShutdown()
 	})
 
+	if p.audit != nil {
+		c.OnStartup(p.audit.OnStartup)
+		c.OnShutdown(p.audit.OnShutdown)
+	}
+
+	if p.admin != nil {
+		// the listener is released before a reloaded instance starts its own
+		c.OnStartup(p.admin.OnStartup)
+		c.OnRestart(p.admin.OnFinalShutdown)
+		c.OnRestartFailed(p.admin.OnStartup)
+		c.OnFinalShutdown(p.admin.OnFinalShutdown)
+	}
+
 	return nil
 }
 
@@ -59,7 +74,11 @@ func parseSetEcs(c *caddy.Controller) (*SetEcs, error) {
 				if plen < 3 {
 					return nil, c.Errf("format is `ecs-binding <1p> clients [ip(cidr) | filepath | url ...]`")
 				}
-				err := secs.parseEcsBinding(remaining[0], remaining[2:])
+				opts, err := parseSourceOptions(c)
+				if err != nil {
+					return nil, err
+				}
+				err = secs.parseEcsBinding(remaining[0], remaining[2:], opts)
 				if err != nil {
 					return nil, c.Errf("parse client data error %s", err.Error())
 				}
@@ -69,7 +88,14 @@ func parseSetEcs(c *caddy.Controller) (*SetEcs, error) {
 				if plen < 1 {
 					return nil, c.Errf("format is `ecs-table [ filepath | url ...]`")
 				}
-				err := secs.parseEcsTable(remaining)
+				opts, err := parseSourceOptions(c)
+				if err != nil {
+					return nil, err
+				}
+				if opts.canary.percent > 0 {
+					return nil, c.Errf("canary applies to ecs-binding only")
+				}
+				err = secs.parseEcsTable(remaining, opts)
 				if err != nil {
 					return nil, c.Errf("parse ecs-table data error %s", err.Error())
 				}
@@ -86,6 +112,69 @@ func parseSetEcs(c *caddy.Controller) (*SetEcs, error) {
 					return nil, c.Errf("invalid negative duration for reload '%s'", remaining[0])
 				}
 				secs.reload = reload
+			case "cache-dir":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("format is `cache-dir <directory>`")
+				}
+				if err := os.MkdirAll(remaining[0], 0o700); err != nil {
+					return nil, c.Errf("cache-dir error %s", err.Error())
+				}
+				secs.cacheDir = remaining[0]
+			case "admin":
+				if secs.admin != nil {
+					return nil, c.Errf("admin may only be set once")
+				}
+				admin, err := parseAdmin(c, secs)
+				if err != nil {
+					return nil, err
+				}
+				secs.admin = admin
+			case "debug-responder":
+				dr, err := parseDebugResponder(c)
+				if err != nil {
+					return nil, err
+				}
+				secs.debugResponder = dr
+			case "chaos-status":
+				cs, err := parseChaosStatus(c)
+				if err != nil {
+					return nil, err
+				}
+				secs.chaosStatus = cs
+			case "audit":
+				audit, err := parseAudit(c)
+				if err != nil {
+					return nil, err
+				}
+				secs.audit = audit
+			case "shadow":
+				if len(c.RemainingArgs()) != 0 {
+					return nil, c.Errf("format is `shadow`")
+				}
+				secs.shadow = true
+			case "experiment":
+				if secs.experiment != nil {
+					return nil, c.Errf("experiment may only be set once")
+				}
+				ex, err := parseExperiment(c)
+				if err != nil {
+					return nil, err
+				}
+				secs.experiment = ex
+			case "default-ecs":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("format is `default-ecs <ecs addr>`")
+				}
+				if secs.defaultEcs = net.ParseIP(remaining[0]); secs.defaultEcs == nil {
+					return nil, c.Errf("error ecsip %s", remaining[0])
+				}
+			case "strip-client-ecs":
+				if len(c.RemainingArgs()) != 0 {
+					return nil, c.Errf("format is `strip-client-ecs`")
+				}
+				secs.stripClientEcs = true
 			case "debug":
 				secs.debug = true
 			default:
@@ -94,5 +183,15 @@ func parseSetEcs(c *caddy.Controller) (*SetEcs, error) {
 		}
 
 	}
+	if secs.admin != nil {
+		if err := secs.admin.loadState(); err != nil {
+			return nil, c.Errf("admin state error %s", err.Error())
+		}
+	}
+	secs.hasShadow = secs.shadow
+	for _, loader := range secs.loaders() {
+		secs.hasShadow = secs.hasShadow || loader.isShadow()
+	}
+	secs.initialLoad()
 	return secs, nil
 }
@@ -0,0 +1,169 @@
+package setecs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// signatureVerifier checks detached signatures of downloaded lists. Both
+// minisign signatures and bare ed25519 signatures are accepted.
+type signatureVerifier struct {
+	keyId  []byte // minisign key id, nil for a bare ed25519 key
+	pubKey ed25519.PublicKey
+}
+
+const (
+	minisignAlgLen = 2
+	minisignIdLen  = 8
+)
+
+// parseVerifyKey accepts a minisign public key, a base64 ed25519 public key,
+// or a file containing either.
+func parseVerifyKey(s string) (*signatureVerifier, error) {
+	if FileExists(s) {
+		b, err := ioutil.ReadFile(s)
+		if err != nil {
+			return nil, err
+		}
+		s = lastDataLine(string(b))
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("verify key is not base64: %v", err)
+	}
+	switch len(raw) {
+	case ed25519.PublicKeySize:
+		return &signatureVerifier{pubKey: ed25519.PublicKey(raw)}, nil
+	case minisignAlgLen + minisignIdLen + ed25519.PublicKeySize:
+		if string(raw[:minisignAlgLen]) != "Ed" {
+			return nil, fmt.Errorf("unsupported minisign key algorithm %q", raw[:minisignAlgLen])
+		}
+		return &signatureVerifier{
+			keyId:  raw[minisignAlgLen : minisignAlgLen+minisignIdLen],
+			pubKey: ed25519.PublicKey(raw[minisignAlgLen+minisignIdLen:]),
+		}, nil
+	}
+	return nil, fmt.Errorf("verify key has invalid length %d", len(raw))
+}
+
+// lastDataLine skips minisign comment lines.
+func lastDataLine(s string) string {
+	var last string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		last = line
+	}
+	return last
+}
+
+func (v *signatureVerifier) verify(content, sig []byte) error {
+	if v.keyId == nil {
+		return v.verifyRaw(content, sig)
+	}
+	return v.verifyMinisign(content, sig)
+}
+
+func (v *signatureVerifier) verifyRaw(content, sig []byte) error {
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			return fmt.Errorf("signature is neither raw nor base64: %v", err)
+		}
+		sig = decoded
+	}
+	if !ed25519.Verify(v.pubKey, content, sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func (v *signatureVerifier) verifyMinisign(content, sig []byte) error {
+	var lines []string
+	for _, line := range strings.Split(string(sig), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") ||
+		!strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != minisignAlgLen+minisignIdLen+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	alg := string(raw[:minisignAlgLen])
+	if !bytes.Equal(raw[minisignAlgLen:minisignAlgLen+minisignIdLen], v.keyId) {
+		return errors.New("signature was made with a different key")
+	}
+	signature := raw[minisignAlgLen+minisignIdLen:]
+	message := content
+	switch alg {
+	case "Ed":
+	case "ED": // prehashed
+		sum := blake2b.Sum512(content)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", alg)
+	}
+	if !ed25519.Verify(v.pubKey, message, signature) {
+		return errors.New("signature mismatch")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("malformed minisign global signature")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(v.pubKey, append(append([]byte{}, signature...), trusted...), globalSig) {
+		return errors.New("trusted comment signature mismatch")
+	}
+	return nil
+}
+
+// verifyFile checks content read from path against the sibling `<path>.sig`.
+func (o *SourceOptions) verifyFile(path string, content []byte) error {
+	if o == nil || o.verifier == nil {
+		return nil
+	}
+	sig, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	return o.verifier.verify(content, sig)
+}
+
+// verifyUrl checks content downloaded from url against `<url>.sig`, it
+// returns the signature, nil without verify-key.
+func (o *SourceOptions) verifyUrl(url string, content []byte) ([]byte, error) {
+	if o == nil || o.verifier == nil {
+		return nil, nil
+	}
+	sig, err := o.fetch(signatureUrl(url))
+	if err != nil {
+		return nil, err
+	}
+	return sig, o.verifier.verify(content, sig)
+}
+
+// signatureUrl appends .sig to the path, keeping any query string.
+func signatureUrl(url string) string {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return url + ".sig"
+	}
+	u.Path += ".sig"
+	u.RawPath = ""
+	return u.String()
+}
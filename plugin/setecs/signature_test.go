@@ -0,0 +1,107 @@
+package setecs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestVerifyRawSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := parseVerifyKey(base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("172.21.1.16\n172.21.2.0/24\n")
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, content))
+	if err := v.verify(content, []byte(sig+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify([]byte("0.0.0.0/0\n"), []byte(sig)); err == nil {
+		t.Fatal("tampered content verified")
+	}
+}
+
+func TestVerifyMinisignSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pubKey := append(append([]byte("Ed"), keyId...), pub...)
+	v, err := parseVerifyKey(base64.StdEncoding.EncodeToString(pubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("172.21.1.16\n")
+	sum := blake2b.Sum512(content)
+	signature := ed25519.Sign(priv, sum[:])
+	trusted := "timestamp:1634567890"
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, signature...), trusted...))
+	sig := "untrusted comment: test\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyId...), signature...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(globalSig) + "\n"
+
+	if err := v.verify(content, []byte(sig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify([]byte("172.21.1.17\n"), []byte(sig)); err == nil {
+		t.Fatal("tampered content verified")
+	}
+}
+
+func TestSignatureUrl(t *testing.T) {
+	got := signatureUrl("https://example.com/clients.txt?v=1")
+	if got != "https://example.com/clients.txt.sig?v=1" {
+		t.Fatalf("unexpected signature url %s", got)
+	}
+}
+
+func TestUrlSourceSignatureFetch(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("172.21.2.0/24\n")
+	sigs := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			sigs++
+			w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, content))))
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+	opts := newSourceOptions()
+	if opts.verifier, err = parseVerifyKey(base64.StdEncoding.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource(srv.URL+"/clients.txt", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := src.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sigs != 1 {
+		t.Fatalf("expected a single signature fetch for unchanged content, got %d", sigs)
+	}
+	content = []byte("172.21.3.0/24\n")
+	if _, err := src.Load(); err != nil || sigs != 2 {
+		t.Fatalf("expected the signature of new content to be fetched, got %d: %v", sigs, err)
+	}
+}
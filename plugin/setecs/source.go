@@ -0,0 +1,323 @@
+package setecs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source is a backend providing the content of a client list or an ecs
+// table. Content is returned in the text format of the lists, so that every
+// backend goes through the same parser and validation.
+type Source interface {
+	// Changed reports whether the source may hold new content since the
+	// last successful Load.
+	Changed() bool
+	// Load returns the current content of the source.
+	Load() ([]byte, error)
+	// Health returns nil when the backend is reachable, otherwise the
+	// last error.
+	Health() error
+	// String describes the source without revealing any secret.
+	String() string
+}
+
+// errReloadRejected is the status of a source whose content a guard rejected.
+var errReloadRejected = errors.New("reload rejected by guard")
+
+// SourceFactory creates the Source of a uri whose scheme the factory was
+// registered for.
+type SourceFactory func(u *neturl.URL, opts *SourceOptions) (Source, error)
+
+var (
+	sourceFactoriesLock sync.RWMutex
+	sourceFactories     = make(map[string]SourceFactory)
+)
+
+// RegisterSource makes a backend available to ecs-binding and ecs-table
+// for uris with the given scheme.
+func RegisterSource(scheme string, factory SourceFactory) {
+	sourceFactoriesLock.Lock()
+	defer sourceFactoriesLock.Unlock()
+	sourceFactories[scheme] = factory
+}
+
+// newSource returns the Source of a Corefile item. It returns nil without
+// an error when the item is neither an existing file nor a uri of a
+// registered scheme.
+func newSource(item string, opts *SourceOptions) (Source, error) {
+	if FileExists(item) {
+		return newFileSource(item, opts), nil
+	}
+	u, err := neturl.Parse(item)
+	if err != nil || u.Scheme == "" {
+		return nil, nil
+	}
+	sourceFactoriesLock.RLock()
+	factory, ok := sourceFactories[u.Scheme]
+	sourceFactoriesLock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	src, err := factory(u, opts)
+	if err != nil {
+		return nil, fmt.Errorf("source %s: %v", redactURL(item), err)
+	}
+	return src, nil
+}
+
+// Watcher is implemented by sources that push change notifications, so that
+// updates are applied without waiting for the reload ticker.
+type Watcher interface {
+	// Watch calls notify whenever the content may have changed, until stop
+	// is closed.
+	Watch(stop <-chan struct{}, notify func())
+}
+
+// watchDebounce delays the notification of a watcher so that a burst of
+// updates, e.g. a writer changing many entries, causes a single load.
+const watchDebounce = 100 * time.Millisecond
+
+// debounceNotify calls notify after watchDebounce unless a call is already
+// pending.
+func debounceNotify(pending *int32, notify func()) {
+	if atomic.CompareAndSwapInt32(pending, 0, 1) {
+		time.AfterFunc(watchDebounce, func() {
+			atomic.StoreInt32(pending, 0)
+			notify()
+		})
+	}
+}
+
+// revisionSource is implemented by sources whose content is versioned, the
+// revision of the content in use is part of the status.
+type revisionSource interface {
+	Revision() int64
+}
+
+// localSource is implemented by sources that are always available and
+// therefore are not kept in the disk cache.
+type localSource interface {
+	local()
+}
+
+// SourceStatus is the load state of a source.
+type SourceStatus struct {
+	Source    string    `json:"source"`
+	LastLoad  time.Time `json:"last_load"`
+	LastError string    `json:"last_error,omitempty"`
+	Entries   int       `json:"entries"`
+	Revision  int64     `json:"revision,omitempty"`
+	Hash      uint64    `json:"hash"` // hash of the content in use
+}
+
+// loadTarget is the binding or table fed by a source.
+type loadTarget interface {
+	// stage parses content, returning the number of entries and a function
+	// that swaps the result in.
+	stage(r io.Reader) (entries int, report *parseReport, commit func())
+	// size returns the number of entries in use.
+	size() int
+}
+
+// sourceLoader drives the Source of a binding or table: it detects changes,
+// parses the content, applies the guards and keeps the status.
+type sourceLoader struct {
+	sync.RWMutex
+	loadLock    sync.Mutex // serializes loads from the ticker and watchers
+	source      Source
+	uri         string
+	opts        *SourceOptions
+	target      loadTarget
+	cacheDir    string
+	changes     *changeNotifier
+	contentHash uint64
+	diagnostics []Diagnostic
+	status      SourceStatus
+}
+
+func newSourceLoader(source Source, uri string, opts *SourceOptions, target loadTarget) *sourceLoader {
+	return &sourceLoader{
+		RWMutex:     sync.RWMutex{},
+		source:      source,
+		uri:         uri,
+		opts:        opts,
+		target:      target,
+		diagnostics: make([]Diagnostic, 0),
+		status:      SourceStatus{Source: source.String()},
+	}
+}
+
+// isShadow reports whether the source is evaluated in shadow mode only.
+func (l *sourceLoader) isShadow() bool {
+	return l.opts != nil && l.opts.shadow
+}
+
+// load refreshes the target when the source changed.
+func (l *sourceLoader) load() {
+	l.loadLock.Lock()
+	defer l.loadLock.Unlock()
+	l.reload()
+}
+
+// reload is load with loadLock held.
+func (l *sourceLoader) reload() {
+	if !l.source.Changed() {
+		return
+	}
+	t1 := time.Now()
+	content, err := l.source.Load()
+	t2 := time.Since(t1)
+	if err != nil {
+		reloads.WithLabelValues(l.source.String(), "failure").Inc()
+		l.setError(err)
+		log.Warningf("Failed to update %q, err: %v", l.source.String(), err)
+		return
+	}
+
+	hash := StringHash(string(content))
+	revision := l.revision()
+	l.RLock()
+	inUse := hash == l.status.Hash
+	seen := hash == l.contentHash
+	l.RUnlock()
+	if inUse {
+		reloads.WithLabelValues(l.source.String(), "success").Inc()
+		l.setLoaded(l.target.size(), hash, revision)
+		return
+	}
+	if seen {
+		// rejected before, keep reporting the rejection
+		reloads.WithLabelValues(l.source.String(), "failure").Inc()
+		l.setError(errReloadRejected)
+		return
+	}
+	if !l.apply(content, hash, revision, t2) {
+		reloads.WithLabelValues(l.source.String(), "failure").Inc()
+		return
+	}
+	reloads.WithLabelValues(l.source.String(), "success").Inc()
+	if _, ok := l.source.(localSource); !ok {
+		var sig []byte
+		if s, ok := l.source.(signedSource); ok {
+			sig = s.signature()
+		}
+		saveCache(l.cacheDir, l.uri, content, sig)
+	}
+}
+
+// signedSource is implemented by sources checking a signature, which is
+// cached with the content.
+type signedSource interface {
+	signature() []byte
+}
+
+// loadFromCache restores the last known good content of a remote source.
+// The cached copy goes through the signature check and the guards of a
+// live load.
+func (l *sourceLoader) loadFromCache() {
+	if _, ok := l.source.(localSource); ok {
+		return
+	}
+	l.loadLock.Lock()
+	defer l.loadLock.Unlock()
+	loadCache(l.cacheDir, l.uri, func(content, sig []byte) bool {
+		if l.opts != nil && l.opts.verifier != nil {
+			err := fmt.Errorf("no cached signature")
+			if sig != nil {
+				err = l.opts.verifier.verify(content, sig)
+			}
+			if err != nil {
+				log.Warningf("Ignoring cached copy of %q, signature verification failed: %v", l.source.String(), err)
+				return false
+			}
+		}
+		return l.apply(content, StringHash(string(content)), 0, 0)
+	})
+}
+
+// apply parses content and swaps it in unless a guard rejects it. The caller
+// holds loadLock across the guard and the commit, so that concurrent loads
+// are never checked against a size that is about to change.
+func (l *sourceLoader) apply(content []byte, hash uint64, revision int64, fetched time.Duration) bool {
+	t1 := time.Now()
+	entries, report, commit := l.target.stage(bytes.NewReader(content))
+	log.Debugf("Loaded %v, time spent: %v %v, added: %v / %v, diagnostics: %v, hash: %#x",
+		l.source.String(), fetched, time.Since(t1), entries, report.totalLines, len(report.diagnostics), hash)
+
+	l.Lock()
+	l.contentHash = hash
+	l.diagnostics = report.diagnostics
+	l.Unlock()
+	if !l.opts.guardReload(l.source.String(), l.target.size(), entries, report.errors()) {
+		l.setError(errReloadRejected)
+		return false
+	}
+	commit()
+	l.setLoaded(entries, hash, revision)
+	return true
+}
+
+func (l *sourceLoader) setError(err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.status.LastError = err.Error()
+}
+
+// revision returns the revision of the content the source just loaded, 0
+// when the source is not versioned.
+func (l *sourceLoader) revision() int64 {
+	if r, ok := l.source.(revisionSource); ok {
+		return r.Revision()
+	}
+	return 0
+}
+
+// setLoaded records the content in use, revision is only taken from a
+// committed load.
+func (l *sourceLoader) setLoaded(entries int, hash uint64, revision int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.status.LastLoad = time.Now()
+	l.status.LastError = ""
+	l.status.Entries = entries
+	sourceEntries.WithLabelValues(l.status.Source).Set(float64(entries))
+	lastLoad.WithLabelValues(l.status.Source).Set(float64(l.status.LastLoad.Unix()))
+	l.status.Hash = hash
+	l.status.Revision = revision
+}
+
+// watch starts the watcher of the source, if any.
+func (l *sourceLoader) watch(stop <-chan struct{}, notify func()) {
+	if w, ok := l.source.(Watcher); ok {
+		go w.Watch(stop, notify)
+	}
+}
+
+// close releases the connections held by the source.
+func (l *sourceLoader) close() {
+	if c, ok := l.source.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warningf("Failed to close %q, err: %v", l.source.String(), err)
+		}
+	}
+}
+
+// Status returns the load state of the source.
+func (l *sourceLoader) Status() SourceStatus {
+	l.RLock()
+	defer l.RUnlock()
+	return l.status
+}
+
+// Diagnostics returns the problems found by the last parse of the source.
+func (l *sourceLoader) Diagnostics() []Diagnostic {
+	l.RLock()
+	defer l.RUnlock()
+	return l.diagnostics
+}
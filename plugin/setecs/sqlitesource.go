@@ -0,0 +1,188 @@
+package setecs
+
+import (
+	"database/sql"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // sqlite driver
+)
+
+func init() {
+	RegisterSource("sqlite", newSqliteSource)
+}
+
+// sqliteSource runs a query against a sqlite database. A query returning one
+// column yields client CIDRs for ecs-binding, a query returning two columns
+// yields client:ecs lines for ecs-table, where the client is an address or a
+// CIDR. The query runs again when the database file or its write-ahead log
+// changes.
+//
+//	sqlite:///var/lib/ipam.db?query=SELECT%20client,%20ecs%20FROM%20ecs_map
+//
+// or with the SQL taken verbatim from the query option:
+//
+//	ecs-table sqlite:///var/lib/ipam.db {
+//	    query "SELECT client, ecs FROM ecs_map WHERE note LIKE '%pop-a%'"
+//	}
+type sqliteSource struct {
+	sync.RWMutex
+	path   string
+	query  string
+	db     *sql.DB
+	stamps map[string]fileStamp
+	err    error
+}
+
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+func newSqliteSource(u *neturl.URL, opts *SourceOptions) (Source, error) {
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("missing database path")
+	}
+	query, err := sqliteQuery(u, opts)
+	if err != nil {
+		return nil, err
+	}
+	dsn := (&neturl.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &sqliteSource{path: path, query: query, db: db, stamps: make(map[string]fileStamp)}, nil
+}
+
+// sqliteQuery returns the SQL of the query option, or else of the url
+// encoded query parameter, decoded once by the url parser.
+func sqliteQuery(u *neturl.URL, opts *SourceOptions) (string, error) {
+	if opts != nil && opts.query != "" {
+		if u.RawQuery != "" || u.Fragment != "" {
+			return "", fmt.Errorf("query option and query parameter are mutually exclusive")
+		}
+		return opts.query, nil
+	}
+	if u.Fragment != "" {
+		return "", fmt.Errorf("'#' in the query parameter starts a url fragment, encode it as %%23 or use the query option")
+	}
+	values, err := neturl.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", fmt.Errorf("query parameter is not url encoded, use the query option: %v", err)
+	}
+	query := values.Get("query")
+	if query == "" {
+		return "", fmt.Errorf("missing query parameter or option")
+	}
+	return query, nil
+}
+
+func (ss *sqliteSource) local() {}
+
+// files are the database and the journals whose changes trigger a reload.
+func (ss *sqliteSource) files() []string {
+	return []string{ss.path, ss.path + "-wal"}
+}
+
+func (ss *sqliteSource) currentStamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, f := range ss.files() {
+		if stat, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{mtime: stat.ModTime(), size: stat.Size()}
+		}
+	}
+	return stamps
+}
+
+func (ss *sqliteSource) Changed() bool {
+	current := ss.currentStamps()
+	ss.RLock()
+	defer ss.RUnlock()
+	if ss.err != nil || len(current) != len(ss.stamps) {
+		return true
+	}
+	for f, stamp := range current {
+		if ss.stamps[f] != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+func (ss *sqliteSource) Load() ([]byte, error) {
+	stamps := ss.currentStamps()
+	content, err := ss.run()
+	ss.Lock()
+	defer ss.Unlock()
+	ss.err = err
+	if err != nil {
+		return nil, err
+	}
+	ss.stamps = stamps
+	return content, nil
+}
+
+func (ss *sqliteSource) run() ([]byte, error) {
+	if !FileExists(ss.path) {
+		return nil, fmt.Errorf("database %s does not exist", ss.path)
+	}
+	rows, err := ss.db.Query(ss.query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) != 1 && len(columns) != 2 {
+		return nil, fmt.Errorf("query must return 1 or 2 columns, got %d", len(columns))
+	}
+
+	sb := strings.Builder{}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if i > 0 {
+				sb.WriteString(":")
+			}
+			sb.WriteString(strings.TrimSpace(v.String))
+		}
+		sb.WriteString("\n")
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return []byte(sb.String()), nil
+}
+
+func (ss *sqliteSource) Health() error {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.err
+}
+
+func (ss *sqliteSource) Close() error {
+	return ss.db.Close()
+}
+
+func (ss *sqliteSource) String() string {
+	return "sqlite:" + ss.path
+}
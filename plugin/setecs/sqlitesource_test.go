@@ -0,0 +1,119 @@
+package setecs
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqliteSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setecs-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.db")
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE hosts (client TEXT, ecs TEXT)",
+		"INSERT INTO hosts VALUES ('10.0.0.1', '1.1.1.1'), ('10.0.0.2', 'bad')",
+		"CREATE TABLE ecs_map (client TEXT, ecs TEXT)",
+		"INSERT INTO ecs_map VALUES ('10.0.0.1', '1.1.1.1'), ('10.1.0.0/16', '2.2.2.2'), ('10.1.5.0/24', '3.3.3.3'), ('10.3.0.0/16', '2.2.2.2')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	se := NewSetEcs()
+	err = se.parseEcsTable([]string{"sqlite://" + path + "?query=SELECT client, ecs FROM hosts"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = se.parseEcsTable([]string{"sqlite://" + path + "?query=SELECT%20client,%20ecs%20FROM%20ecs_map"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := newSourceOptions()
+	opts.query = "SELECT client FROM ecs_map WHERE client LIKE '%/%'"
+	err = se.parseEcsBinding("8.8.8.8", []string{"sqlite://" + path}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se.initialLoad()
+
+	if ip := se.MatchEcsTable("10.0.0.1"); !ip.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("expected table entry, got %v", ip)
+	}
+	if diags := se.ecsTables[0].Diagnostics(); len(diags) != 1 || diags[0].Line != 2 {
+		t.Fatalf("expected a diagnostic for the invalid row, got %v", diags)
+	}
+	if status := se.ecsTables[1].loader.Status(); status.LastError != "" || status.Entries != 4 {
+		t.Fatalf("expected the table with CIDR rows to load, got %+v", status)
+	}
+	if groups := se.ecsTables[1].groups; len(groups) != 2 || len(groups[0].clients) != 2 {
+		t.Fatalf("expected the CIDR rows grouped by ecs address, got %+v", groups)
+	}
+	for client, ecs := range map[string]string{"10.1.2.3": "2.2.2.2", "10.1.5.9": "3.3.3.3", "10.3.0.1": "2.2.2.2"} {
+		if ip := se.MatchEcsTable(client); !ip.Equal(net.ParseIP(ecs)) {
+			t.Fatalf("expected %s for %s, got %v", ecs, client, ip)
+		}
+	}
+	if ip := se.MatchEcsBinding(net.ParseIP("10.1.2.3")); !ip.Equal(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("expected binding entry, got %v", ip)
+	}
+
+	loader := se.ecsBindings[0].loader
+	if loader.source.Changed() {
+		t.Fatal("unchanged database reported as changed")
+	}
+	if _, err := db.Exec("INSERT INTO ecs_map VALUES ('10.2.0.0/16', '2.2.2.2')"); err != nil {
+		t.Fatal(err)
+	}
+	if !loader.source.Changed() {
+		t.Fatal("expected change after insert")
+	}
+	se.updateList()
+	if ip := se.MatchEcsBinding(net.ParseIP("10.2.2.3")); ip == nil {
+		t.Fatal("expected new binding entry after reload")
+	}
+	if ip := se.MatchEcsTable("10.2.2.3"); !ip.Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("expected new table CIDR after reload, got %v", ip)
+	}
+}
+
+func TestSqliteQuery(t *testing.T) {
+	verbatim := newSourceOptions()
+	verbatim.query = "SELECT client FROM nets WHERE note LIKE '%#1%'"
+	for _, c := range []struct {
+		item string
+		opts *SourceOptions
+		want string
+	}{
+		{"sqlite:///ipam.db?query=SELECT client FROM nets", nil, "SELECT client FROM nets"},
+		{"sqlite:///ipam.db?query=SELECT%20client%20FROM%20nets%20WHERE%20a%2Bb%20%3E%201", nil, "SELECT client FROM nets WHERE a+b > 1"},
+		{"sqlite:///ipam.db", verbatim, verbatim.query},
+		{"sqlite:///ipam.db?query=SELECT client FROM nets WHERE note LIKE '%/%'", nil, ""},
+		{"sqlite:///ipam.db?query=SELECT client FROM nets -- #1", nil, ""},
+		{"sqlite:///ipam.db?query=SELECT 1", verbatim, ""},
+		{"sqlite:///ipam.db", nil, ""},
+	} {
+		u, err := neturl.Parse(c.item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := sqliteQuery(u, c.opts)
+		if got != c.want || (err == nil) != (c.want != "") {
+			t.Errorf("sqliteQuery(%s) = %q, %v, want %q", c.item, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package setecs
+
+import (
+	"fmt"
+	neturl "net/url"
+	"sync"
+)
+
+func init() {
+	RegisterSource("http", newUrlSource)
+	RegisterSource("https", newUrlSource)
+}
+
+// urlSource downloads a list over http(s) using the tls and auth settings
+// of the source. It always reports a change, the loader compares content
+// hashes instead.
+type urlSource struct {
+	sync.RWMutex
+	url  string
+	opts *SourceOptions
+	err  error
+	sig  []byte // signature of the last content
+	hash uint64 // hash of the content the signature was verified for
+}
+
+func newUrlSource(u *neturl.URL, opts *SourceOptions) (Source, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return &urlSource{url: u.String(), opts: opts}, nil
+}
+
+func (us *urlSource) Changed() bool { return true }
+
+func (us *urlSource) Load() ([]byte, error) {
+	content, err := us.opts.fetch(us.url)
+	hash := StringHash(string(content))
+	us.RLock()
+	sig, verified := us.sig, us.sig != nil && hash == us.hash
+	us.RUnlock()
+	if err == nil && !verified {
+		// the signature is only fetched for new content
+		var verr error
+		if sig, verr = us.opts.verifyUrl(us.url, content); verr != nil {
+			err = fmt.Errorf("signature verification failed: %v", verr)
+		}
+	}
+	us.Lock()
+	us.err = err
+	if err == nil {
+		us.sig, us.hash = sig, hash
+	}
+	us.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// signature returns the signature of the last content, cached with it.
+func (us *urlSource) signature() []byte {
+	us.RLock()
+	defer us.RUnlock()
+	return us.sig
+}
+
+func (us *urlSource) Health() error {
+	us.RLock()
+	defer us.RUnlock()
+	return us.err
+}
+
+func (us *urlSource) String() string {
+	return redactURL(us.url)
+}
@@ -14,7 +14,11 @@ import (
 // 解析 IP 到网络对象
 func parseIpNet(d string) (inet iplib.Net, err error) {
 	if !strings.Contains(d, "/") {
-		d = d + "/32"
+		if strings.Contains(d, ":") {
+			d = d + "/128"
+		} else {
+			d = d + "/32"
+		}
 	}
 	_net := iplib.Net4FromStr(d)
 	if _net.IP() == nil {
@@ -107,7 +111,11 @@ func removeECS(m *dns.Msg) (removedECS *dns.EDNS0_SUBNET) {
 
 func ParseIpNet(d string) (inet iplib.Net, err error) {
 	if !strings.Contains(d, "/") {
-		d = d + "/32"
+		if strings.Contains(d, ":") {
+			d = d + "/128"
+		} else {
+			d = d + "/32"
+		}
 	}
 	_net := iplib.Net4FromStr(d)
 	if _net.IP() == nil {